@@ -1,25 +1,54 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/mail"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 )
 
 // ========== MODELS ============//
 type Note struct {
-	ID      int    `json:"id"`
-	Title   string `json:"title"`
-	Content string `json:"content"`
-	UserID  int    `json:"user_id"`
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Content   string `json:"content"`
+	UserID    int    `json:"user_id"`
+	CreatedAt string `json:"created_at,omitempty"`
 }
 
 // represents registered user
@@ -27,34 +56,146 @@ type Note struct {
 type User struct {
 	ID       int    `json:"id"`
 	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
 	Password string `json:"password"`
 }
 
 // ============GLOBALS==========//
 var db *sql.DB
-var jwtKey = []byte("my_secret_key") // secret key for signing tokens
+var jwtKey []byte // secret key for signing tokens, loaded from JWT_SECRET in main
 
 // structure of jwt
+// auth_time = when user actually logged in, kept same across refreshes
 type Claims struct {
-	UserId int `json:"user_id"`
+	UserId   int    `json:"user_id"`
+	Role     string `json:"role,omitempty"` // "user" or "admin", empty in tokens from before roles
+	AuthTime int64  `json:"auth_time,omitempty"`
 	jwt.StandardClaims
 }
 
+// who can sign up
+// open -> anyone, closed -> nobody (403), invite -> only with an unused invite code
+var signupMode = "open"
+
+// signup body, same as user plus optional invite code
+type signupRequest struct {
+	User
+	InviteCode string `json:"invite_code"`
+}
+
+// min password length, from MIN_PASSWORD_LEN
+var minPasswordLen = 8
+
+// cost for new password hashes, BCRYPT_COST (4-31)
+// existing hashes keep the cost they were made with, bcrypt stores it in the hash
+var bcryptCost = 12
+
+// returns the rules password breaks (empty if it is fine)
+func checkPasswordPolicy(password string) []string {
+	var failed []string
+	if utf8.RuneCountInString(password) < minPasswordLen {
+		failed = append(failed, fmt.Sprintf("must be at least %d characters", minPasswordLen))
+	}
+	hasLetter, hasDigit := false, false
+	for _, c := range password {
+		if unicode.IsLetter(c) {
+			hasLetter = true
+		} else if unicode.IsDigit(c) {
+			hasDigit = true
+		}
+	}
+	if !hasLetter {
+		failed = append(failed, "must contain a letter")
+	}
+	if !hasDigit {
+		failed = append(failed, "must contain a digit")
+	}
+	return failed
+}
+
+// trims username (so " alice" and "alice" are the same account) and checks both fields are set
+// returns error message, empty if ok
+func validateCredentials(u *User) string {
+	u.Username = strings.TrimSpace(u.Username)
+	if u.Username == "" {
+		return "username is required"
+	}
+	if u.Password == "" {
+		return "password is required"
+	}
+	return ""
+}
+
+// plain address only ("a@b.com", not "A <a@b.com>"), lowercased so lookups and the unique index ignore case
+// returns the normalized email, or error message
+func normalizeEmail(email string) (string, string) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", "email is required"
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", "email is not a valid address"
+	}
+	return strings.ToLower(email), ""
+}
+
 // signup new user
 func signupHandler(w http.ResponseWriter, r *http.Request) {
-	var user User
-	json.NewDecoder(r.Body).Decode(&user)
+	if signupMode == "closed" {
+		http.Error(w, "Signup is disabled", http.StatusForbidden)
+		return
+	}
+	var req signupRequest
+	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	user := req.User
+	email, hashedPassword, ok := prepareNewUser(w, &user)
+	if !ok {
+		return
+	}
 
-	// Hash the plain password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	// invite code is used up in same tx as user insert, so one code = one account
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+	if signupMode == "invite" {
+		res, err := tx.Exec("UPDATE invite_codes SET used_at = CURRENT_TIMESTAMP WHERE code = ? AND used_at IS NULL", req.InviteCode)
+		if err != nil {
+			http.Error(w, "Error creating user", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			http.Error(w, "Invalid invite code", http.StatusForbidden)
+			return
+		}
+	}
 
 	// Insert into database
-	_, err = db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", user.Username, string(hashedPassword))
-	if err != nil {
+	res, err := tx.Exec("INSERT INTO users (username, email, password_hash) VALUES (?, ?, ?)", user.Username, email, hashedPassword)
+	if isUniqueViolation(err) {
+		writeUserConflict(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+	if signupMode == "invite" {
+		id, _ := res.LastInsertId()
+		if _, err := tx.Exec("UPDATE invite_codes SET used_by = ? WHERE code = ?", id, req.InviteCode); err != nil {
+			http.Error(w, "Error creating user", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
@@ -63,14 +204,89 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "User created successfully"})
 }
 
+// checks username, email and password policy of a new account and hashes the password
+// writes the 400 itself, ok is false then
+func prepareNewUser(w http.ResponseWriter, user *User) (email, hash string, ok bool) {
+	if msg := validateCredentials(user); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return "", "", false
+	}
+	email, msg := normalizeEmail(user.Email)
+	if msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return "", "", false
+	}
+	if failed := checkPasswordPolicy(user.Password); len(failed) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"error": "password is too weak", "failed_rules": failed})
+		return "", "", false
+	}
+
+	// Hash the plain password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcryptCost)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return "", "", false
+	}
+	return email, string(hashedPassword), true
+}
+
+// 409 for a users insert that hit the username or email unique index
+func writeUserConflict(w http.ResponseWriter, err error) {
+	// sqlite names the column in the message: "UNIQUE constraint failed: users.email"
+	if strings.Contains(err.Error(), "users.email") {
+		writeJSONError(w, http.StatusConflict, "email already registered")
+	} else {
+		writeJSONError(w, http.StatusConflict, "username already taken")
+	}
+}
+
+// true when err is sqlite UNIQUE constraint failure
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// add invite codes from INVITE_CODES (comma separated), already known codes are left alone
+func seedInviteCodes(codes string) error {
+	for _, code := range strings.Split(codes, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		if _, err := db.Exec("INSERT OR IGNORE INTO invite_codes (code) VALUES (?)", code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	var creds User
-	json.NewDecoder(r.Body).Decode(&creds)
+	if err := decodeJSON(r, &creds); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	// login with {"email": ...} works too, "username" may also hold an email
+	if strings.TrimSpace(creds.Username) == "" {
+		creds.Username = creds.Email
+	}
+	if msg := validateCredentials(&creds); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
 
 	// Fetch user from DB
+	// someone's username can look like another user's email, the username match wins then
 	var dbUser User
-	err := db.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", creds.Username).
-		Scan(&dbUser.ID, &dbUser.Password) // dbUser.Password will actually hold the hashed password
+	var role string
+	err := db.QueryRow("SELECT id, password_hash, role FROM users WHERE username = ? OR (email = ? AND email != '') ORDER BY username = ? DESC LIMIT 1",
+		creds.Username, strings.ToLower(creds.Username), creds.Username).
+		Scan(&dbUser.ID, &dbUser.Password, &role) // dbUser.Password will actually hold the hashed password
 	if err != nil {
 		http.Error(w, "Invalid Username", http.StatusUnauthorized)
 		return
@@ -83,17 +299,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate JWT token
-	expirationTime := time.Now().Add(1 * time.Hour)
-	claims := &Claims{
-		UserId: dbUser.ID,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenString, err := issueToken(dbUser.ID, role)
 	if err != nil {
 		http.Error(w, "Could not generate token", http.StatusInternalServerError)
 		return
@@ -102,99 +308,2876 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
 }
 
-// Middleware to protect routes
-func authMiddleware(next http.Handler) http.Handler {
+// login brute force protection: at most loginRateLimit attempts per ip in loginRateWindow (sliding window)
+var loginRateLimit = 5
+var loginRateWindow = time.Minute
+
+// TRUST_PROXY=true -> we run behind our own reverse proxy, take client ip from X-Forwarded-For
+// never enable it when clients can reach us directly, they could just make up the header
+var trustProxy = false
+
+var loginAttempts = struct {
+	sync.Mutex
+	byIP map[string][]time.Time
+}{byIP: map[string][]time.Time{}}
+
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		// proxy appends the address it saw, so the last entry is the one we can trust
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// networks that may reach /v1/admin/*, ADMIN_ALLOW_CIDRS / ADMIN_DENY_CIDRS (comma separated)
+// empty allowlist -> any ip, a deny entry wins over an allow entry
+var adminAllowNets, adminDenyNets []*net.IPNet
+
+// "10.0.0.0/8, 192.168.1.5" -> networks, a bare ip is a network of just that address
+func parseCIDRs(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(v, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", c)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 403 for admin requests from outside the allowed networks, checked before the token
+// uses clientIP, so behind a proxy it needs TRUST_PROXY to see the real address
+func adminIPMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenStr := r.Header.Get("Authorization")
-		if tokenStr == "" {
-			http.Error(w, "Missing Token", http.StatusUnauthorized)
+		ip := net.ParseIP(clientIP(r))
+		if ip == nil || inNets(ip, adminDenyNets) || len(adminAllowNets) > 0 && !inNets(ip, adminAllowNets) {
+			writeJSONError(w, http.StatusForbidden, "admin endpoints are not reachable from this address")
 			return
 		}
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid Token", http.StatusUnauthorized)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// records an attempt for ip, returns how long to wait when over the limit (0 = allowed)
+func allowLogin(ip string, now time.Time) time.Duration {
+	loginAttempts.Lock()
+	defer loginAttempts.Unlock()
+	recent := loginAttempts.byIP[ip][:0]
+	for _, t := range loginAttempts.byIP[ip] {
+		if now.Sub(t) < loginRateWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= loginRateLimit {
+		loginAttempts.byIP[ip] = recent
+		return loginRateWindow - now.Sub(recent[0])
+	}
+	loginAttempts.byIP[ip] = append(recent, now)
+	return 0
+}
+
+// drop ips with no attempt inside the window so the map doesn't grow forever
+func cleanupLoginAttempts(ctx context.Context) {
+	ticker := time.NewTicker(loginRateWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			loginAttempts.Lock()
+			for ip, times := range loginAttempts.byIP {
+				if len(times) == 0 || now.Sub(times[len(times)-1]) >= loginRateWindow {
+					delete(loginAttempts.byIP, ip)
+				}
+			}
+			loginAttempts.Unlock()
+		}
+	}
+}
+
+// 429 + Retry-After (seconds, rounded up) once an ip used up its attempts
+func loginRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := allowLogin(clientIP(r), time.Now()); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			writeJSONError(w, http.StatusTooManyRequests, "too many login attempts, try again later")
 			return
 		}
-		// store user id
-		r.Header.Set("userId", fmt.Sprint(claims.UserId))
 		next.ServeHTTP(w, r)
 	})
 }
 
-func createNoteHandler(w http.ResponseWriter, r *http.Request) {
-	var note Note
-	json.NewDecoder(r.Body).Decode(&note)
-	// get user id from req header set in middleware
-	userId := r.Header.Get("userId")
-	_, err := db.Exec("INSERT INTO notes (title, content, user_id) VALUES (?, ?, ?)", note.Title, note.Content, userId)
+// lifetime of issued tokens, JWT_TTL
+var jwtTTL = time.Hour
+
+// Generate signed JWT token for a fresh login
+func issueToken(userId int, role string) (string, error) {
+	return signToken(userId, role, time.Now().Unix())
+}
+
+// iat is needed to reject tokens issued before a password change
+func signToken(userId int, role string, authTime int64) (string, error) {
+	now := time.Now()
+	expirationTime := now.Add(jwtTTL)
+	claims := &Claims{
+		UserId:   userId,
+		Role:     role,
+		AuthTime: authTime,
+		StandardClaims: jwt.StandardClaims{
+			// random jti: two tokens from the same second must not be equal, logout revokes by hash
+			Id:        newRequestID(),
+			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  now.Unix(),
+			// jwt-go's Valid() rejects iat or nbf in the future, so a token can't be minted ahead of time
+			NotBefore: now.Unix(),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+// how long after expiry a token can still be refreshed
+var refreshGrace = 5 * time.Minute
+
+// max time since login after which refresh is refused and user must log in again
+var maxRefreshWindow = 24 * time.Hour
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// swap a valid (or just expired) token for a new one
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	tokenStr, err := bearerToken(r)
 	if err != nil {
-		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Note created"})
+	if tokenStr == "" {
+		writeJSONError(w, http.StatusUnauthorized, "missing token")
+		return
+	}
+	claims, err := validateToken(tokenStr)
+	if errors.Is(err, errTokenExpired) {
+		if time.Since(time.Unix(claims.ExpiresAt, 0)) > refreshGrace {
+			writeJSONError(w, http.StatusUnauthorized, "token expired too long ago, please log in again")
+			return
+		}
+		// validateToken stops at expiry, so revocation still has to be checked
+		revoked, rerr := tokenRevoked(tokenStr, claims)
+		if rerr != nil {
+			writeJSONError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if revoked {
+			err = errTokenRevoked
+		} else {
+			err = nil
+		}
+	}
+	if errors.Is(err, errTokenRevoked) {
+		writeJSONError(w, http.StatusUnauthorized, "token revoked")
+		return
+	} else if errors.Is(err, errTokenNoIssuedAt) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid token: no iat claim")
+		return
+	} else if errors.Is(err, errTokenInvalid) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid token")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	// older tokens have no auth_time, fall back to iat
+	authTime := claims.AuthTime
+	if authTime == 0 {
+		authTime = claims.IssuedAt
+	}
+	if time.Since(time.Unix(authTime, 0)) > maxRefreshWindow {
+		writeJSONError(w, http.StatusUnauthorized, "refresh window exceeded, please log in again")
+		return
+	}
+	// role is read again, a demoted admin doesn't keep admin by refreshing
+	role, err := userRole(claims.UserId)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	tokenString, err := signToken(claims.UserId, role, authTime)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not generate token")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
 }
 
-func getNotesHandler(w http.ResponseWriter, r *http.Request) {
-	userId := r.Header.Get("userId")
-	rows, err := db.Query("SELECT id, title, content, user_id FROM notes WHERE user_id = ?", userId)
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+// revoke the token of this request, it stays on revoked_tokens until refresh couldn't take it anymore
+// goes behind authMiddleware, so a token that is already invalid never gets here
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	tokenStr, _ := bearerToken(r)
+	claims := &Claims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenStr, claims); err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "invalid token")
 		return
 	}
-	defer rows.Close()
-	var notes []Note
-	for rows.Next() {
-		var note Note
-		rows.Scan(&note.ID, &note.Title, &note.Content, &note.UserID)
-		notes = append(notes, note)
+	expiresAt := time.Unix(claims.ExpiresAt, 0).Add(refreshGrace).Unix()
+	if _, err := db.Exec("INSERT OR IGNORE INTO revoked_tokens (token_hash, expires_at) VALUES (?, ?)", hashToken(tokenStr), expiresAt); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
 	}
-	json.NewEncoder(w).Encode(notes)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
 }
 
-func main() {
-	var err error
-	db, err = sql.Open("sqlite3", "./notes.db")
+// how often expired rows are dropped from revoked_tokens, REVOKED_TOKEN_SWEEP_INTERVAL
+var revokedTokenSweepInterval = 10 * time.Minute
+
+// delete revoked tokens that expired before now, returns how many
+func sweepRevokedTokens(now time.Time) (int64, error) {
+	res, err := db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", now.Unix())
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL
-		);
-	`)
+	return res.RowsAffected()
+}
+
+// sweep every interval until ctx is done
+func runRevokedTokenSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n, err := sweepRevokedTokens(now); err != nil {
+				log.Printf("sweeping revoked tokens: %v", err)
+			} else if n > 0 {
+				log.Printf("swept %d expired revoked tokens", n)
+			}
+		}
+	}
+}
+
+// change password of logged in user
+// bumps password_changed_at so tokens issued before now stop working, a fresh token is returned
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	var hash, role string
+	err := db.QueryRow("SELECT password_hash, role FROM users WHERE id = ?", userId).Scan(&hash, &role)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusUnauthorized, "user not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.OldPassword)) != nil {
+		writeJSONError(w, http.StatusUnauthorized, "old password is wrong")
+		return
+	}
+	if failed := checkPasswordPolicy(req.NewPassword); len(failed) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"error": "password is too weak", "failed_rules": failed})
+		return
+	}
+	newHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcryptCost)
 	if err != nil {
-		log.Fatal(err)
+		writeJSONError(w, http.StatusInternalServerError, "error hashing password")
+		return
 	}
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS notes (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			title TEXT,
-			content TEXT,
-			user_id INTEGER,
-			FOREIGN KEY(user_id) REFERENCES users(id)
-		);
-	`)
+	_, err = db.Exec("UPDATE users SET password_hash = ?, password_changed_at = ? WHERE id = ?", string(newHash), time.Now().UnixNano(), userId)
 	if err != nil {
-		log.Fatal(err)
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	tokenString, err := issueToken(userId, role)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not generate token")
+		return
 	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed", "token": tokenString})
+}
 
-	//Router
-	r := mux.NewRouter()
-	r.HandleFunc("/signup", signupHandler).Methods("POST")
-	r.HandleFunc("/login", loginHandler).Methods("POST")
-	// protected routes
-	r.Handle("/notes", authMiddleware(http.HandlerFunc(createNoteHandler))).Methods("POST")
-	r.Handle("/notes", authMiddleware(http.HandlerFunc(getNotesHandler))).Methods("GET")
+// token is revoked if it was logged out, or issued before user's last password change
+// (or if user doesn't exist anymore)
+// password_changed_at is unix nanoseconds, iat only whole seconds: both are compared in seconds
+// and a token from the same second as the change stays valid (the one changePasswordHandler returns is such a token)
+func tokenRevoked(tokenStr string, claims *Claims) (bool, error) {
+	var changedAt int64
+	err := db.QueryRow("SELECT password_changed_at FROM users WHERE id = ?", claims.UserId).Scan(&changedAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	var loggedOut int
+	if err := db.QueryRow("SELECT COUNT(*) FROM revoked_tokens WHERE token_hash = ?", hashToken(tokenStr)).Scan(&loggedOut); err != nil {
+		return false, err
+	}
+	if loggedOut > 0 {
+		return true, nil
+	}
+	return claims.IssuedAt < changedAt/int64(time.Second), nil
+}
+
+func userRole(userId int) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE id = ?", userId).Scan(&role)
+	return role, err
+}
+
+// key used to verify token signature
+// only HMAC is accepted, otherwise a token with alg "none" or RS256 could
+// trick the parser into checking it with a different algorithm than we sign with
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return jwtKey, nil
+}
+
+// sign a throwaway token and verify it back with keyFunc, main passes jwtKeyFunc (the one used for requests)
+// run at startup so a broken key setup fails fast instead of on every login
+func selfTestJWT(keyFunc jwt.Keyfunc) error {
+	tokenStr, err := signToken(0, "", time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("jwt self-test: signing failed: %w", err)
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keyFunc)
+	if err != nil || !token.Valid {
+		return fmt.Errorf("jwt self-test: signed token does not verify: %v", err)
+	}
+	return nil
+}
+
+var errTokenInvalid = errors.New("invalid")
+var errTokenExpired = errors.New("expired")
+var errTokenRevoked = errors.New("revoked")
+
+// revocation compares against iat, a token without it can't be checked (signToken always sets it)
+var errTokenNoIssuedAt = fmt.Errorf("%w: token has no iat claim", errTokenInvalid)
 
-	fmt.Println("Server running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+// parse and check token: signature, expiry, and revocation
+// any other error is a db problem
+func validateToken(tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, jwtKeyFunc)
+	var ve *jwt.ValidationError
+	expired := errors.As(err, &ve) && ve.Errors == jwt.ValidationErrorExpired
+	if !expired && (err != nil || !token.Valid) {
+		return nil, errTokenInvalid
+	}
+	if claims.IssuedAt == 0 {
+		return nil, errTokenNoIssuedAt
+	}
+	if expired {
+		return claims, errTokenExpired
+	}
+	revoked, err := tokenRevoked(tokenStr, claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return claims, errTokenRevoked
+	}
+	return claims, nil
+}
+
+// max tokens in one introspect-batch call
+var maxIntrospectBatch = 100
+
+type introspection struct {
+	Active    bool   `json:"active"`
+	UserID    int    `json:"user_id,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Error     string `json:"error,omitempty"` // invalid, expired or revoked
+}
+
+// shared secret the api gateway sends as "Bearer <secret>" to introspect, INTROSPECT_CLIENT_SECRET
+// empty -> only admins can call introspect-batch
+var introspectClientSecret string
+
+// introspection tells whether any token is live, so callers must be authenticated themselves (RFC 7662 section 2.1)
+// either the gateway with introspectClientSecret or a user with an admin token
+func introspectAuthMiddleware(next http.Handler) http.Handler {
+	asAdmin := authMiddleware(requireRole("admin")(next))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenStr, err := bearerToken(r)
+		if err == nil && introspectClientSecret != "" && subtle.ConstantTimeCompare([]byte(tokenStr), []byte(introspectClientSecret)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		asAdmin.ServeHTTP(w, r)
+	})
+}
+
+// check many tokens at once (for api gateway), result order matches input
+func introspectBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tokens []string `json:"tokens"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(req.Tokens) > maxIntrospectBatch {
+		http.Error(w, fmt.Sprintf("At most %d tokens per request", maxIntrospectBatch), http.StatusBadRequest)
+		return
+	}
+	results := make([]introspection, 0, len(req.Tokens))
+	for _, t := range req.Tokens {
+		claims, err := validateToken(t)
+		switch {
+		case err == nil:
+			results = append(results, introspection{Active: true, UserID: claims.UserId, ExpiresAt: claims.ExpiresAt})
+		case errors.Is(err, errTokenExpired), errors.Is(err, errTokenRevoked):
+			results = append(results, introspection{UserID: claims.UserId, ExpiresAt: claims.ExpiresAt, Error: err.Error()})
+		case errors.Is(err, errTokenInvalid):
+			results = append(results, introspection{Error: errTokenInvalid.Error()})
+		default:
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]introspection{"results": results})
+}
+
+type ctxKey string
+
+// unexported key type, so nothing outside this package can set it
+const userIDKey ctxKey = "userId"
+const roleKey ctxKey = "role"
+
+// user id stored by authMiddleware, ok is false if request didn't go through it
+func userIDFromContext(r *http.Request) (int, bool) {
+	id, ok := r.Context().Value(userIDKey).(int)
+	return id, ok
+}
+
+// token from Authorization header, "Bearer <token>" or bare "<token>" (older clients)
+// empty string means header is missing, error means prefix was sent without a token
+func bearerToken(r *http.Request) (string, error) {
+	v := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(v) >= len("Bearer") && strings.EqualFold(v[:len("Bearer")], "Bearer") {
+		rest := v[len("Bearer"):]
+		// "Bearer" alone, or "Bearer" followed by spaces only
+		if strings.TrimSpace(rest) == "" {
+			return "", errors.New("malformed Authorization header: missing token after Bearer")
+		}
+		// "Bearerxyz" is not a prefix, treat whole thing as bare token
+		if rest[0] == ' ' || rest[0] == '\t' {
+			return strings.TrimSpace(rest), nil
+		}
+	}
+	return v, nil
+}
+
+// Middleware to protect routes
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// user id used to travel in this header, drop it so a client can never inject one
+		r.Header.Del("userId")
+		tokenStr, err := bearerToken(r)
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if tokenStr == "" {
+			http.Error(w, "Missing Token", http.StatusUnauthorized)
+			return
+		}
+		claims, err := validateToken(tokenStr)
+		if errors.Is(err, errTokenRevoked) {
+			http.Error(w, "Token revoked", http.StatusUnauthorized)
+			return
+		} else if errors.Is(err, errTokenNoIssuedAt) {
+			http.Error(w, "Invalid Token: no iat claim", http.StatusUnauthorized)
+			return
+		} else if errors.Is(err, errTokenInvalid) || errors.Is(err, errTokenExpired) {
+			http.Error(w, "Invalid Token", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		// pass user id to handlers through request context
+		ctx := context.WithValue(r.Context(), userIDKey, claims.UserId)
+		ctx = context.WithValue(ctx, roleKey, claims.Role)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// goes inside authMiddleware, 403 unless the token carries role
+// the role comes from the token, so a role change shows up on the next login or refresh
+func requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got, _ := r.Context().Value(roleKey).(string); got != role {
+				writeJSONError(w, http.StatusForbidden, "forbidden")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ========== CONTENT SCHEMA ============//
+// users with structured notes (json in content) can set a JSON Schema
+// when set, content of every new note is checked against it
+// when not set, no validation happens at all
+
+// set/replace schema of current user, body is the schema itself
+func putContentSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	// compile once here so a broken schema is rejected before saving
+	if _, err := jsonschema.CompileString("schema.json", string(body)); err != nil {
+		http.Error(w, "Invalid schema: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	_, err = db.Exec("INSERT INTO content_schemas (user_id, schema) VALUES (?, ?) ON CONFLICT(user_id) DO UPDATE SET schema = excluded.schema", userId, string(body))
+	if err != nil {
+		http.Error(w, "Error saving schema", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Schema saved"})
+}
+
+// remove schema, validation is turned off again
+func deleteContentSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM content_schemas WHERE user_id = ?", userId); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// returns list of schema errors (nil if content is fine or no schema is set)
+// error is only returned for db/schema loading problems
+func validateNoteContent(userId int, content string) ([]string, error) {
+	var schemaStr string
+	err := db.QueryRow("SELECT schema FROM content_schemas WHERE user_id = ?", userId).Scan(&schemaStr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	schema, err := jsonschema.CompileString("schema.json", schemaStr)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(content), &v); err != nil {
+		return []string{"content is not valid JSON"}, nil
+	}
+	err = schema.Validate(v)
+	if err == nil {
+		return nil, nil
+	}
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return nil, err
+	}
+	var errs []string
+	for _, e := range ve.BasicOutput().Errors {
+		// skip the top level "doesn't validate with ..." wrappers, keep actual reasons
+		if e.KeywordLocation == "" {
+			continue
+		}
+		errs = append(errs, e.InstanceLocation+": "+e.Error)
+	}
+	if len(errs) == 0 {
+		errs = []string{ve.Error()}
+	}
+	return errs, nil
+}
+
+// ========== STORAGE QUOTA ============//
+// max total bytes of note content per user, 0 means no limit
+var byteQuota int64 = 0
+
+// *sql.DB and *sql.Tx both have QueryRow
+type rowQueryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// bytes of content stored by user
+// CAST to BLOB so LENGTH counts bytes and not characters
+func storageUsed(q rowQueryer, userId int) (int64, error) {
+	var used int64
+	err := q.QueryRow("SELECT COALESCE(SUM(LENGTH(CAST(content AS BLOB))), 0) FROM notes WHERE user_id = ?", userId).Scan(&used)
+	return used, err
+}
+
+// true if user can store extra more bytes
+func withinByteQuota(tx *sql.Tx, userId int, extra int) (bool, error) {
+	if byteQuota <= 0 {
+		return true, nil
+	}
+	used, err := storageUsed(tx, userId)
+	if err != nil {
+		return false, err
+	}
+	return used+int64(extra) <= byteQuota, nil
+}
+
+// ========== NOTE COUNTS ============//
+// per user note count is kept in note_counts so counting is a single row lookup
+// it is changed in the same tx as the insert/delete, and rebuilt on startup
+
+// add delta to user's cached count (creates the row on first note)
+func addNoteCount(tx *sql.Tx, userId int, delta int) error {
+	_, err := tx.Exec(`INSERT INTO note_counts (user_id, count) VALUES (?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET count = count + excluded.count`, userId, delta)
+	return err
+}
+
+func cachedNoteCount(userId int) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT count FROM note_counts WHERE user_id = ?", userId).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
+
+// recompute all counts from notes table, fixes any drift (e.g. rows changed by hand)
+func reconcileNoteCounts() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM note_counts"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO note_counts (user_id, count) SELECT user_id, COUNT(*) FROM notes WHERE user_id IS NOT NULL GROUP BY user_id"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func countNotesHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	count, err := cachedNoteCount(userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"count": count})
+}
+
+// usage numbers of current user
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	count, err := cachedNoteCount(userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	used, err := storageUsed(db, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{
+		"note_count": int64(count),
+		"bytes_used": used,
+		"byte_quota": byteQuota,
+	})
+}
+
+func createNoteHandler(w http.ResponseWriter, r *http.Request) {
+	var note Note
+	if err := decodeJSON(r, &note); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	// get user id from req header set in middleware
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// check content against user's schema (if they configured one)
+	schemaErrs, err := validateNoteContent(userId, note.Content)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if schemaErrs != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": schemaErrs})
+		return
+	}
+	// quota check and insert in one tx so two parallel creates can't both squeeze under the limit
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	allowed, err := withinByteQuota(tx, userId, len(note.Content))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Storage quota exceeded", http.StatusForbidden)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO notes (title, content, user_id, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)", note.Title, note.Content, userId)
+	if err != nil {
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	if err := addNoteCount(tx, userId, 1); err != nil {
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Note created"})
+}
+
+// look up owner and content of a note inside tx
+// sql.ErrNoRows if note doesn't exist
+func noteOwner(tx *sql.Tx, id int) (ownerId int, content string, err error) {
+	err = tx.QueryRow("SELECT user_id, content FROM notes WHERE id = ?", id).Scan(&ownerId, &content)
+	return ownerId, content, err
+}
+
+// get own note by id
+// filtering on user_id in sql means another user's note looks exactly like a missing one
+func getNoteHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		return
+	}
+	var note Note
+	err = db.QueryRow("SELECT id, title, content, user_id FROM notes WHERE id = ? AND user_id = ?", id, userId).
+		Scan(&note.ID, &note.Title, &note.Content, &note.UserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// update own note by id
+func updateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		return
+	}
+	var note Note
+	if err := decodeJSON(r, &note); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	schemaErrs, err := validateNoteContent(userId, note.Content)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if schemaErrs != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": schemaErrs})
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	ownerId, oldContent, err := noteOwner(tx, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if ownerId != userId {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// only growing a note can go over quota, shrinking is always allowed
+	if extra := len(note.Content) - len(oldContent); extra > 0 {
+		allowed, err := withinByteQuota(tx, userId, extra)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Storage quota exceeded", http.StatusForbidden)
+			return
+		}
+	}
+	_, err = tx.Exec("UPDATE notes SET title = ?, content = ? WHERE id = ? AND user_id = ?", note.Title, note.Content, id, userId)
+	if err != nil {
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	note.ID = id
+	note.UserID = userId
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// delete own note by id
+func deleteNoteHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	ownerId, _, err := noteOwner(tx, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if ownerId != userId {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM notes WHERE id = ? AND user_id = ?", id, userId); err != nil {
+		http.Error(w, "Error deleting note", http.StatusInternalServerError)
+		return
+	}
+	if err := addNoteCount(tx, userId, -1); err != nil {
+		http.Error(w, "Error deleting note", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error deleting note", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// paging of GET /notes
+const defaultNotesLimit = 20
+const maxNotesLimit = 100
+
+// read non negative int query param, def if missing
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative number", name)
+	}
+	return n, nil
+}
+
+// escape LIKE wildcards so ?q= matches them literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func getNotesHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultNotesLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxNotesLimit)
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := "SELECT id, title, content, user_id FROM notes WHERE user_id = ?"
+	args := []any{userId}
+	if q := r.URL.Query().Get("q"); q != "" {
+		query += ` AND (title LIKE '%' || ? || '%' ESCAPE '\' OR content LIKE '%' || ? || '%' ESCAPE '\')`
+		q = likeEscaper.Replace(q)
+		args = append(args, q, q)
+	}
+	// ORDER BY so pages don't overlap or skip rows
+	query += " ORDER BY id LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var notes []Note
+	for rows.Next() {
+		var note Note
+		rows.Scan(&note.ID, &note.Title, &note.Content, &note.UserID)
+		notes = append(notes, note)
+	}
+	json.NewEncoder(w).Encode(notes)
+}
+
+// get notes of current user with exact title
+// titles are not unique so this returns a list
+func getNotesByTitleHandler(w http.ResponseWriter, r *http.Request) {
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		http.Error(w, "Missing title", http.StatusBadRequest)
+		return
+	}
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rows, err := db.Query("SELECT id, title, content, user_id FROM notes WHERE user_id = ? AND title = ?", userId, title)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	// empty slice (not nil) so no match encodes as [] instead of null
+	notes := []Note{}
+	for rows.Next() {
+		var note Note
+		if err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.UserID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		notes = append(notes, note)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notes)
+}
+
+// ========== ADMIN ============//
+
+// body of POST /admin/users, role defaults to "user"
+type adminCreateUserRequest struct {
+	User
+	Role string `json:"role"`
+}
+
+// admin creates an account directly, works whatever SIGNUP_MODE is (no invite code needed)
+func adminCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req adminCreateUserRequest
+	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	if req.Role == "" {
+		req.Role = "user"
+	}
+	if req.Role != "user" && req.Role != "admin" {
+		writeJSONError(w, http.StatusBadRequest, `role must be "user" or "admin"`)
+		return
+	}
+	user := req.User
+	email, hash, ok := prepareNewUser(w, &user)
+	if !ok {
+		return
+	}
+	res, err := db.Exec("INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, ?, ?)", user.Username, email, hash, req.Role)
+	if isUniqueViolation(err) {
+		writeUserConflict(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "username": user.Username, "email": email, "role": req.Role})
+}
+
+// all notes of all users, paged like GET /notes
+func adminNotesHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", defaultNotesLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxNotesLimit)
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := db.Query("SELECT id, title, content, user_id FROM notes ORDER BY id LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	notes := []Note{}
+	for rows.Next() {
+		var note Note
+		if err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.UserID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		notes = append(notes, note)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notes)
+}
+
+// max time of one integrity check, DB_CHECK_TIMEOUT
+var dbCheckTimeout = 30 * time.Second
+
+// PRAGMA integrity_check on demand (after a crash, disk trouble, restoring a copy)
+// result is ["ok"] for a healthy db, otherwise the problems sqlite found
+func adminDBCheckHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), dbCheckTimeout)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		writeDBCheckError(ctx, w, err)
+		return
+	}
+	defer rows.Close()
+	result := []string{}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			writeDBCheckError(ctx, w, err)
+			return
+		}
+		result = append(result, line)
+	}
+	if err := rows.Err(); err != nil {
+		writeDBCheckError(ctx, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ok": len(result) == 1 && result[0] == "ok", "result": result})
+}
+
+func writeDBCheckError(ctx context.Context, w http.ResponseWriter, err error) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		writeJSONError(w, http.StatusGatewayTimeout, "integrity check timed out")
+		return
+	}
+	log.Printf("integrity check: %v", err)
+	writeJSONError(w, http.StatusInternalServerError, "database error")
+}
+
+// first admin from ADMIN_USERNAME / ADMIN_EMAIL / ADMIN_PASSWORD
+// does nothing when env is unset or an admin already exists, so the env can stay set
+func seedAdmin() error {
+	username, password := strings.TrimSpace(os.Getenv("ADMIN_USERNAME")), os.Getenv("ADMIN_PASSWORD")
+	if username == "" && password == "" {
+		return nil
+	}
+	var admins int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin'").Scan(&admins); err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+	if username == "" {
+		return errors.New("ADMIN_USERNAME must be set together with ADMIN_PASSWORD")
+	}
+	if failed := checkPasswordPolicy(password); len(failed) > 0 {
+		return fmt.Errorf("ADMIN_PASSWORD %s", strings.Join(failed, ", "))
+	}
+	email, msg := normalizeEmail(os.Getenv("ADMIN_EMAIL"))
+	if msg != "" {
+		return fmt.Errorf("ADMIN_EMAIL: %s", msg)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, ?, 'admin')", username, email, string(hash))
+	if isUniqueViolation(err) {
+		return fmt.Errorf("can't seed admin: username %q or its email is already taken", username)
+	} else if err != nil {
+		return err
+	}
+	slog.Info("seeded admin user", "username", username)
+	return nil
+}
+
+// ========== ENCRYPTED BACKUP ============//
+// blob layout: magic | salt | nonce | AES-256-GCM(json notes)
+// key is derived from client passphrase with scrypt, passphrase is never stored
+// passphrase comes in a header so it doesn't end up in urls/access logs
+const backupMagic = "NBK1"
+const backupSaltLen = 16
+
+// derive 32 byte AES key from passphrase (scrypt params as recommended for interactive use)
+func deriveBackupKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 32768, 8, 1, 32)
+}
+
+func newBackupAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := deriveBackupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptBackup(passphrase string, plaintext []byte) ([]byte, error) {
+	salt := make([]byte, backupSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newBackupAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(backupMagic), salt...)
+	out = append(out, nonce...)
+	// magic+salt is authenticated too so header can't be swapped
+	return aead.Seal(out, nonce, plaintext, out[:len(backupMagic)+backupSaltLen]), nil
+}
+
+var errBadBackup = errors.New("backup is corrupt or passphrase is wrong")
+
+func decryptBackup(passphrase string, blob []byte) ([]byte, error) {
+	headerLen := len(backupMagic) + backupSaltLen
+	if len(blob) < headerLen || string(blob[:len(backupMagic)]) != backupMagic {
+		return nil, errBadBackup
+	}
+	salt := blob[len(backupMagic):headerLen]
+	aead, err := newBackupAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < headerLen+aead.NonceSize() {
+		return nil, errBadBackup
+	}
+	nonce := blob[headerLen : headerLen+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, blob[headerLen+aead.NonceSize():], blob[:headerLen])
+	if err != nil {
+		return nil, errBadBackup
+	}
+	return plaintext, nil
+}
+
+// export all notes of current user as encrypted blob
+func exportBackupHandler(w http.ResponseWriter, r *http.Request) {
+	passphrase := r.Header.Get("X-Backup-Passphrase")
+	if passphrase == "" {
+		http.Error(w, "Missing X-Backup-Passphrase header", http.StatusBadRequest)
+		return
+	}
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rows, err := db.Query("SELECT id, title, content, user_id FROM notes WHERE user_id = ?", userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	notes := []Note{}
+	for rows.Next() {
+		var note Note
+		if err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.UserID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		notes = append(notes, note)
+	}
+	plaintext, _ := json.Marshal(notes)
+	blob, err := encryptBackup(passphrase, plaintext)
+	if err != nil {
+		http.Error(w, "Could not encrypt backup", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="notes.backup"`)
+	w.Write(blob)
+}
+
+// import encrypted blob made by exportBackupHandler, notes get new ids
+func importBackupHandler(w http.ResponseWriter, r *http.Request) {
+	passphrase := r.Header.Get("X-Backup-Passphrase")
+	if passphrase == "" {
+		http.Error(w, "Missing X-Backup-Passphrase header", http.StatusBadRequest)
+		return
+	}
+	blob, err := io.ReadAll(r.Body)
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	plaintext, err := decryptBackup(passphrase, blob)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var notes []Note
+	if err := json.Unmarshal(plaintext, &notes); err != nil {
+		http.Error(w, "Invalid backup contents", http.StatusBadRequest)
+		return
+	}
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// all or nothing, so a failed import doesn't leave half the notes behind
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	size := 0
+	for _, note := range notes {
+		size += len(note.Content)
+	}
+	allowed, err := withinByteQuota(tx, userId, size)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Storage quota exceeded", http.StatusForbidden)
+		return
+	}
+	for _, note := range notes {
+		if _, err := tx.Exec("INSERT INTO notes (title, content, user_id, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)", note.Title, note.Content, userId); err != nil {
+			http.Error(w, "Error saving note", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := addNoteCount(tx, userId, len(notes)); err != nil {
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"imported": len(notes)})
+}
+
+// read int config from env, fallback to default when unset or invalid
+func getEnvInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using default %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// read bool config from env ("1", "true", ...), fallback to default when unset or invalid
+func getEnvBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using default %t", name, v, def)
+		return def
+	}
+	return b
+}
+
+// read duration config from env (like "30s"), fallback to default when unset or invalid
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("invalid %s=%q, using default %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// hard ceiling for a whole request
+var requestTimeout = 30 * time.Second
+
+// buffers handler output so nothing reaches client after a timeout
+// (same idea as http.TimeoutHandler but the 504 body is json)
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = code
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+// cancel request context after requestTimeout and answer 504 json
+// handlers/db calls using r.Context() stop their work when it fires
+func timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+		select {
+		case p := <-panicked:
+			// re-panic in serving goroutine so it is handled like any other panic
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for k, v := range tw.header {
+				w.Header()[k] = v
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(map[string]string{"error": "request timed out"})
+		}
+	})
+}
+
+// limits for query string, checked before any handler calls r.URL.Query()
+var maxQueryParams = 50
+var maxRepeatedParam = 10
+
+// browser origins allowed to call this api, from ALLOWED_ORIGINS (comma separated)
+// empty -> no CORS headers, only same-origin pages can use it
+var allowedOrigins = map[string]bool{}
+
+func parseAllowedOrigins(v string) {
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			allowedOrigins[o] = true
+		}
+	}
+}
+
+// what cross-origin requests may send, and which response headers scripts may read
+const corsAllowMethods = "GET, POST, PUT, DELETE"
+const corsAllowHeaders = "Content-Type, Authorization, X-Backup-Passphrase, X-Request-ID"
+const corsExposeHeaders = "Location, Content-Disposition, X-Request-ID"
+
+// echoes the origin back only when allowlisted (never "*", so cookies/auth headers work)
+// preflight OPTIONS is answered here with 204, router has no OPTIONS routes
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !allowedOrigins[origin] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		h.Add("Vary", "Origin")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ========== REQUEST ID ============//
+// every request gets an id: the caller's X-Request-ID if it looks sane, else a new uuid
+// it is echoed back in the response and logged, so one request can be followed across services
+
+const requestIDKey ctxKey = "requestId"
+
+// longer or odd looking ids are replaced, they end up in log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// random (version 4) uuid
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// "" when the request didn't go through requestIDMiddleware
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// one line per request, text by default, LOG_FORMAT=json for log collectors
+var accessLog = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+func setLogFormat(format string) {
+	switch strings.ToLower(format) {
+	case "", "text":
+	case "json":
+		accessLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	default:
+		log.Printf("unknown LOG_FORMAT=%q, using text", format)
+	}
+}
+
+// remembers status and bytes written so they can be logged afterwards
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.size += n
+	return n, err
+}
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		// handler that writes nothing is an implicit 200
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		accessLog.Info("request",
+			"request_id", requestIDFromContext(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sr.status,
+			"size", sr.size,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+// ========== GZIP ============//
+// for list endpoints, wrap the handler: gzipMiddleware(http.HandlerFunc(h))
+
+// smaller bodies are sent as is, gzip overhead isn't worth it
+const gzipMinSize = 1024
+
+// true when Accept-Encoding lists gzip with a non-zero q
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(v, 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// holds back the first gzipMinSize bytes to decide if compressing is worth it
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	buf     []byte
+	status  int
+	started bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
+	}
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.started {
+		g.buf = append(g.buf, b...)
+		if len(g.buf) < gzipMinSize {
+			return len(b), nil
+		}
+		if err := g.start(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// sends the header and whatever is buffered, compressed or not
+func (g *gzipWriter) start() error {
+	g.started = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	h := g.Header()
+	ct := h.Get("Content-Type")
+	// already encoded by the handler, or a format that is compressed anyway
+	compressed := h.Get("Content-Encoding") != "" || strings.HasPrefix(ct, "image/") ||
+		ct == "application/zip" || ct == "application/gzip"
+	if len(g.buf) >= gzipMinSize && !compressed && g.status != http.StatusNoContent && g.status != http.StatusNotModified {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(g.buf)
+	} else {
+		_, err = g.ResponseWriter.Write(g.buf)
+	}
+	g.buf = nil
+	return err
+}
+
+func (g *gzipWriter) Flush() {
+	if !g.started {
+		g.start()
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writes out a small body that never reached gzipMinSize, and the gzip footer
+func (g *gzipWriter) close() {
+	if !g.started {
+		g.start()
+	}
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// caches must keep gzip and plain versions apart
+		w.Header().Add("Vary", "Accept-Encoding")
+		g := &gzipWriter{ResponseWriter: w}
+		defer g.close()
+		next.ServeHTTP(g, r)
+	})
+}
+
+// max size of a POST/PUT/PATCH body, MAX_BODY_BYTES to change
+var maxBodyBytes int64 = 1 << 20
+
+// cap request bodies so a huge payload can't eat all memory while decoding
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decode json body, unknown fields are an error so client typos don't get silently dropped
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// sends 413 and returns true when err came from hitting maxBodyBytes
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return true
+	}
+	return false
+}
+
+// turns a handler panic into a 500 instead of killing the connection
+// stack goes to the log, client only gets a generic message
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// net/http uses this one on purpose to abort a response, let it through
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			log.Printf("panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestIDFromContext(r.Context()), p, debug.Stack())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reject requests with too many query params (or one key repeated too many times)
+// counts raw "&" separated pairs so nothing big gets allocated for bad requests
+func queryLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.RawQuery
+		if raw != "" {
+			if strings.Count(raw, "&")+1 > maxQueryParams {
+				http.Error(w, "Too many query parameters", http.StatusBadRequest)
+				return
+			}
+			seen := make(map[string]int)
+			for _, pair := range strings.Split(raw, "&") {
+				key, _, _ := strings.Cut(pair, "=")
+				seen[key]++
+				if seen[key] > maxRepeatedParam {
+					http.Error(w, "Query parameter repeated too many times", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// set to true once startup (db, tables, config) is done
+// /readyz reports 503 until then
+var ready atomic.Bool
+
+// liveness -> process is running, nothing else is checked
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readiness -> startup finished and db answers ping
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "starting"})
+		return
+	}
+	if err := db.PingContext(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "database unavailable"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
+// ========== PASSWORDLESS (CHALLENGE) ============//
+// user registers an ed25519 public key once (while logged in)
+// to log in: GET /auth/challenge gives a nonce, client signs the nonce string
+// with its private key and sends signature to POST /auth/challenge/verify
+
+const challengeTTL = 2 * time.Minute
+
+// caps on pending challenges, so GET /auth/challenge can't be used to fill memory
+// MAX_PENDING_CHALLENGES for all clients together, MAX_CHALLENGES_PER_IP for one client ip
+var maxPendingChallenges = 10000
+var maxChallengesPerIP = 5
+
+type challenge struct {
+	username string
+	ip       string
+	expires  time.Time
+}
+
+// pending nonces, each can be used only once
+// challengesByIP counts the pending ones per ip, both guarded by challengesMu
+var challenges = make(map[string]challenge)
+var challengesByIP = make(map[string]int)
+var challengesMu sync.Mutex
+
+// take nonce out of the pending set, caller holds challengesMu
+func removeChallenge(nonce string) (challenge, bool) {
+	c, ok := challenges[nonce]
+	if !ok {
+		return c, false
+	}
+	delete(challenges, nonce)
+	if challengesByIP[c.ip]--; challengesByIP[c.ip] <= 0 {
+		delete(challengesByIP, c.ip)
+	}
+	return c, true
+}
+
+// drop expired challenges, runs from cleanupChallenges instead of on every request
+func sweepChallenges(now time.Time) {
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+	for n, c := range challenges {
+		if now.After(c.expires) {
+			removeChallenge(n)
+		}
+	}
+}
+
+func cleanupChallenges(ctx context.Context) {
+	ticker := time.NewTicker(challengeTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sweepChallenges(now)
+		}
+	}
+}
+
+// register public key (base64, 32 bytes) for current user
+func addPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(req.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		http.Error(w, "public_key must be a base64 ed25519 public key", http.StatusBadRequest)
+		return
+	}
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO user_keys (user_id, public_key) VALUES (?, ?)", userId, req.PublicKey); err != nil {
+		http.Error(w, "Error saving key", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Key registered"})
+}
+
+// give out a fresh nonce for username
+func challengeHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "Missing username", http.StatusBadRequest)
+		return
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Could not create challenge", http.StatusInternalServerError)
+		return
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(buf)
+	ip := clientIP(r)
+	challengesMu.Lock()
+	if len(challenges) >= maxPendingChallenges || challengesByIP[ip] >= maxChallengesPerIP {
+		challengesMu.Unlock()
+		// expired ones are swept every challengeTTL, a slot frees up by then at the latest
+		w.Header().Set("Retry-After", strconv.Itoa(int(challengeTTL/time.Second)))
+		http.Error(w, "Too many pending challenges", http.StatusTooManyRequests)
+		return
+	}
+	challenges[nonce] = challenge{username: username, ip: ip, expires: time.Now().Add(challengeTTL)}
+	challengesByIP[ip]++
+	challengesMu.Unlock()
+	// same response for unknown users so this can't be used to find usernames
+	json.NewEncoder(w).Encode(map[string]string{"nonce": nonce})
+}
+
+// check signed nonce and issue token
+func verifyChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username  string `json:"username"`
+		Nonce     string `json:"nonce"`
+		Signature string `json:"signature"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	// take nonce out right away so it can't be replayed, even if verify fails
+	challengesMu.Lock()
+	c, ok := removeChallenge(req.Nonce)
+	challengesMu.Unlock()
+	if !ok || c.username != req.Username || time.Now().After(c.expires) {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	sig, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	// role comes from the same query: with one pool conn a second query while rows is open would wait forever
+	rows, err := db.Query("SELECT k.user_id, k.public_key, u.role FROM user_keys k JOIN users u ON u.id = k.user_id WHERE u.username = ?", req.Username)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	userId, role := 0, ""
+	for rows.Next() {
+		var id int
+		var keyStr, keyRole string
+		if err := rows.Scan(&id, &keyStr, &keyRole); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		key, err := base64.StdEncoding.DecodeString(keyStr)
+		if err == nil && len(key) == ed25519.PublicKeySize && ed25519.Verify(key, []byte(req.Nonce), sig) {
+			userId, role = id, keyRole
+			break
+		}
+	}
+	if userId == 0 {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	tokenString, err := issueToken(userId, role)
+	if err != nil {
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+}
+
+// notes created on same month/day as today (or ?date=YYYY-MM-DD) in any year, oldest year first
+func onThisDayHandler(w http.ResponseWriter, r *http.Request) {
+	day := time.Now().UTC()
+	if d := r.URL.Query().Get("date"); d != "" {
+		parsed, err := time.Parse("2006-01-02", d)
+		if err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		day = parsed
+	}
+	days := []string{day.Format("01-02")}
+	// leap day notes would never show up in non leap years, so show them on Feb 28
+	if day.Month() == time.February && day.Day() == 28 && !isLeapYear(day.Year()) {
+		days = append(days, "02-29")
+	}
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rows, err := db.Query(
+		"SELECT id, title, content, user_id, created_at FROM notes WHERE user_id = ? AND strftime('%m-%d', created_at) IN (?, ?) ORDER BY created_at",
+		userId, days[0], days[len(days)-1],
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	notes := []Note{}
+	for rows.Next() {
+		var note Note
+		if err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.UserID, &note.CreatedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		notes = append(notes, note)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notes)
+}
+
+func isLeapYear(y int) bool {
+	return y%4 == 0 && (y%100 != 0 || y%400 == 0)
+}
+
+// ========== BACKGROUND IMPORT ============//
+// POST /notes/import answers 202 right away, notes are saved by a small worker pool
+// job status lives in memory, so it is kept only while the process runs
+
+type importJob struct {
+	ID       string `json:"id"`
+	UserID   int    `json:"-"`
+	Status   string `json:"status"` // queued, running, done
+	Total    int    `json:"total"`
+	Imported int    `json:"imported"`
+	Failed   int    `json:"failed"`
+	notes    []Note
+	finished time.Time // when it became done, zero before
+}
+
+var importJobs = make(map[string]*importJob)
+var importJobsMu sync.Mutex
+
+// done jobs stay visible this long for clients polling their status, IMPORT_JOB_TTL
+var importJobTTL = time.Hour
+
+// forget done jobs older than importJobTTL, queued/running ones are always kept
+func sweepImportJobs(now time.Time) {
+	importJobsMu.Lock()
+	defer importJobsMu.Unlock()
+	for id, job := range importJobs {
+		if job.Status == "done" && now.Sub(job.finished) >= importJobTTL {
+			delete(importJobs, id)
+		}
+	}
+}
+
+func cleanupImportJobs(ctx context.Context) {
+	ticker := time.NewTicker(importJobTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sweepImportJobs(now)
+		}
+	}
+}
+
+// queue for workers, when full new imports get 503
+var importQueue chan *importJob
+var importWorkers = 2
+
+func startImportWorkers() {
+	importQueue = make(chan *importJob, 100)
+	for i := 0; i < importWorkers; i++ {
+		runBackground(func(ctx context.Context) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-importQueue:
+					runImportJob(ctx, job)
+				}
+			}
+		})
+	}
+}
+
+// save notes one by one, a failing note is counted and skipped
+// on shutdown (ctx done) the notes not saved yet count as failed
+func runImportJob(ctx context.Context, job *importJob) {
+	importJobsMu.Lock()
+	job.Status = "running"
+	importJobsMu.Unlock()
+	for i, note := range job.notes {
+		if ctx.Err() != nil {
+			importJobsMu.Lock()
+			job.Failed += len(job.notes) - i
+			importJobsMu.Unlock()
+			break
+		}
+		err := importOneNote(job.UserID, note)
+		importJobsMu.Lock()
+		if err != nil {
+			job.Failed++
+		} else {
+			job.Imported++
+		}
+		importJobsMu.Unlock()
+	}
+	importJobsMu.Lock()
+	job.Status = "done"
+	job.finished = time.Now()
+	job.notes = nil
+	importJobsMu.Unlock()
+}
+
+func importOneNote(userId int, note Note) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	allowed, err := withinByteQuota(tx, userId, len(note.Content))
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return errors.New("storage quota exceeded")
+	}
+	if _, err := tx.Exec("INSERT INTO notes (title, content, user_id, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)", note.Title, note.Content, userId); err != nil {
+		return err
+	}
+	if err := addNoteCount(tx, userId, 1); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func importNotesHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var notes []Note
+	if err := decodeJSON(r, &notes); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Could not create job", http.StatusInternalServerError)
+		return
+	}
+	job := &importJob{
+		ID:     base64.RawURLEncoding.EncodeToString(buf),
+		UserID: userId,
+		Status: "queued",
+		Total:  len(notes),
+		notes:  notes,
+	}
+	importJobsMu.Lock()
+	importJobs[job.ID] = job
+	importJobsMu.Unlock()
+	select {
+	case importQueue <- job:
+	default:
+		importJobsMu.Lock()
+		delete(importJobs, job.ID)
+		importJobsMu.Unlock()
+		http.Error(w, "Too many imports in progress, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/notes/import/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"job_id": job.ID})
+}
+
+// progress of an import job, only its owner can see it
+func importStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	jobId := mux.Vars(r)["jobId"]
+	importJobsMu.Lock()
+	job, found := importJobs[jobId]
+	var snapshot importJob
+	if found {
+		snapshot = *job
+	}
+	importJobsMu.Unlock()
+	if !found || snapshot.UserID != userId {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+	snapshot.notes = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// optional features of this deployment, so clients know what they can use
+// keep this cheap, it is public and can be called often
+func capabilities() map[string]bool {
+	return map[string]bool{
+		"content_schema":   true,
+		"signup":           signupMode != "closed",
+		"invite_only":      signupMode == "invite",
+		"encrypted_backup": true,
+		"passwordless":     true,
+		"storage_quota":    byteQuota > 0,
+	}
+}
+
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capabilities())
+}
+
+// ========== MIGRATIONS ============//
+// schema changes in order, each one runs once and is recorded in schema_migrations
+// never change an entry that already shipped, append a new version instead
+type migration struct {
+	version int
+	sql     string
+}
+
+var migrations = []migration{
+	// 1 -> schema as it was before migrations (IF NOT EXISTS so existing dbs just get it recorded)
+	{1, `
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS notes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			title TEXT,
+			content TEXT,
+			user_id INTEGER,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`},
+	// almost every notes query filters by user_id, without this each one scans the whole table
+	// EXPLAIN QUERY PLAN SELECT ... FROM notes WHERE user_id = ? -> SEARCH notes USING INDEX idx_notes_user_id (user_id=?)
+	{2, `CREATE INDEX IF NOT EXISTS idx_notes_user_id ON notes(user_id)`},
+	// sqlite can't add a NOT NULL column without a default, users from before this get ''
+	// so the unique index skips them
+	{3, `
+		ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+		CREATE UNIQUE INDEX idx_users_email ON users(email) WHERE email != '';
+	`},
+	// expires_at / used_at are unix seconds, used_at NULL -> token can still be used
+	{4, `
+		CREATE TABLE password_resets (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			used_at INTEGER,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`},
+	{5, `ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user'`},
+	{6, `
+		CREATE TABLE invite_codes (
+			code TEXT PRIMARY KEY,
+			used_by INTEGER,
+			used_at DATETIME,
+			FOREIGN KEY(used_by) REFERENCES users(id)
+		);
+		CREATE TABLE user_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			public_key TEXT NOT NULL,
+			UNIQUE(user_id, public_key),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		CREATE TABLE note_counts (
+			user_id INTEGER PRIMARY KEY,
+			count INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		CREATE TABLE content_schemas (
+			user_id INTEGER PRIMARY KEY,
+			schema TEXT NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+	`},
+	// unix nanoseconds of the last password change, 0 -> never changed
+	{7, `ALTER TABLE users ADD COLUMN password_changed_at INTEGER NOT NULL DEFAULT 0`},
+	// ADD COLUMN only takes a constant default, so inserts set created_at themselves
+	{8, `ALTER TABLE notes ADD COLUMN created_at DATETIME`},
+	// creation time of older notes is unknown, the time of the upgrade is the best guess
+	{9, `UPDATE notes SET created_at = CURRENT_TIMESTAMP WHERE created_at IS NULL`},
+	// tokens given up with POST /logout, expires_at is unix seconds, after it the row can go
+	{10, `
+		CREATE TABLE revoked_tokens (
+			token_hash TEXT PRIMARY KEY,
+			expires_at INTEGER NOT NULL
+		);
+		CREATE INDEX idx_revoked_tokens_expires_at ON revoked_tokens(expires_at);
+	`},
+}
+
+// bring db schema up to date, safe to call on every start
+func migrate(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at DATETIME DEFAULT CURRENT_TIMESTAMP)")
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// one migration and its schema_migrations row in the same tx, so it's never half applied
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var done int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = ?", m.version).Scan(&done); err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+	// sqlite has no ADD COLUMN IF NOT EXISTS, so a leading ALTER is left out
+	// when pragma table_info already lists the column
+	stmts := m.sql
+	if c := addColumnRe.FindStringSubmatch(stmts); c != nil {
+		has, err := hasColumn(tx, c[1], c[2])
+		if err != nil {
+			return err
+		}
+		if has {
+			_, stmts, _ = strings.Cut(stmts, ";")
+		}
+	}
+	if strings.TrimSpace(stmts) != "" {
+		if _, err := tx.Exec(stmts); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", m.version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ALTER TABLE <table> ADD COLUMN <column> at the start of a migration
+var addColumnRe = regexp.MustCompile(`^\s*ALTER TABLE (\w+) ADD COLUMN (\w+)`)
+
+// true when table already has the column
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n)
+	return n > 0, err
+}
+
+// connection pool
+// sqlite allows only one writer at a time, with many open conns concurrent writes
+// fail with "database is locked" instead of waiting. one conn serializes all queries
+// in Go (no lock errors, but reads wait behind writes). DB_MAX_OPEN_CONNS raises it,
+// only worth it with WAL mode and mostly-read traffic, <= 0 means no limit.
+// idle conns are kept and never expire: closing the last conn
+// of a ":memory:" db would throw the whole db away
+var dbMaxOpenConns = 1
+
+func configurePool() {
+	dbMaxOpenConns = getEnvInt("DB_MAX_OPEN_CONNS", dbMaxOpenConns)
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(max(dbMaxOpenConns, 2))
+	db.SetConnMaxLifetime(0)
+}
+
+// requests being served right now, reported when shutting down
+var inFlight atomic.Int64
+
+func inFlightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// set by serve once SIGINT/SIGTERM arrived
+var shuttingDown atomic.Bool
+
+// 503 for anything that still comes in while draining (keep-alive conns, the load balancer
+// not caught up yet), so clients retry on another instance. probes still answer, /readyz says 503 itself
+func shutdownMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isProbe := r.URL.Path == "/livez" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+		if shuttingDown.Load() && !isProbe {
+			w.Header().Set("Retry-After", strconv.Itoa(int(shutdownTimeout/time.Second)))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": "server is shutting down"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middleware around the whole router instead of r.Use: mux runs r.Use middleware only
+// for a matched route, so its own 404/405 would get no request id and no access log line
+// same in every service
+func serverHandler(h http.Handler) http.Handler {
+	return requestIDMiddleware(loggingMiddleware(recoverMiddleware(inFlightMiddleware(shutdownMiddleware(corsMiddleware(h))))))
+}
+
+// how long running requests get to finish after SIGINT/SIGTERM
+var shutdownTimeout = 15 * time.Second
+
+// cleanup loops and import workers, serve cancels backgroundCtx on shutdown
+// and waits (up to shutdownTimeout) for all of them to return before the db is closed
+var backgroundCtx, stopBackground = context.WithCancel(context.Background())
+var background sync.WaitGroup
+
+// run fn in its own goroutine until backgroundCtx is done
+func runBackground(fn func(ctx context.Context)) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn(backgroundCtx)
+	}()
+}
+
+// cancel the background workers and wait for them, false if they were still running after timeout
+func stopBackgroundWorkers(timeout time.Duration) bool {
+	stopBackground()
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// serve until SIGINT/SIGTERM, then stop accepting connections and wait for running requests
+func serve(srv *http.Server) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	sig := <-stop
+	shuttingDown.Store(true)
+	// tell load balancer to stop sending traffic
+	ready.Store(false)
+	pending := inFlight.Load()
+	log.Printf("got %v, draining %d in-flight requests", sig, pending)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown timed out with %d requests still running: %v", inFlight.Load(), err)
+	} else {
+		log.Printf("drained %d requests, server stopped", pending)
+	}
+	// loops that use the db must be done before it is closed
+	if !stopBackgroundWorkers(shutdownTimeout) {
+		log.Printf("background workers still running after %v", shutdownTimeout)
+	}
+	// import jobs still queued fail from here on, they only live in memory anyway
+	if err := db.Close(); err != nil {
+		log.Printf("closing db: %v", err)
+	}
+}
+
+// profile of the token's user, no password hash
+type profile struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"` // empty for users from before emails
+	Role     string `json:"role"`
+}
+
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := userIDFromContext(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	p := profile{ID: userId}
+	err := db.QueryRow("SELECT username, email, role FROM users WHERE id = ?", userId).Scan(&p.Username, &p.Email, &p.Role)
+	if err == sql.ErrNoRows {
+		// authMiddleware already treats tokens of deleted users as revoked, this is the race in between
+		writeJSONError(w, http.StatusNotFound, "user not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// ========== PASSWORD RESET ============//
+// POST /forgot-password {email} -> single use token valid for passwordResetTTL
+// POST /reset-password {token, new_password} -> sets the new password
+// there is no mailer yet: the token is logged, DEV_MODE=true also returns it in the response
+
+var passwordResetTTL = 15 * time.Minute
+var devMode = false
+
+// only the sha256 is stored, a leaked db doesn't give out working tokens
+// (reset tokens, and jwts in revoked_tokens)
+func hashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	email, msg := normalizeEmail(req.Email)
+	if msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
+	// same answer whether the email is registered or not, so this can't be used to find accounts
+	resp := map[string]string{"message": "If the email is registered, a reset link was sent"}
+	var userId int
+	err := db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userId)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(resp)
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not create reset token")
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	_, err = db.Exec("INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), userId, time.Now().Add(passwordResetTTL).Unix())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	// stands in for the email until there is a mailer
+	slog.Info("password reset requested", "user_id", userId, "token", token)
+	if devMode {
+		resp["reset_token"] = token
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	if failed := checkPasswordPolicy(req.NewPassword); len(failed) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"error": "password is too weak", "failed_rules": failed})
+		return
+	}
+	newHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcryptCost)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error hashing password")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer tx.Rollback()
+	// using the token up and checking it is one statement, two requests with the same token can't both pass
+	now := time.Now().Unix()
+	var userId int
+	err = tx.QueryRow("UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ? RETURNING user_id",
+		now, hashToken(req.Token), now).Scan(&userId)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusBadRequest, "invalid, expired or already used reset token")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	// like change-password, tokens issued before now stop working
+	if _, err := tx.Exec("UPDATE users SET password_hash = ?, password_changed_at = ? WHERE id = ?", string(newHash), time.Now().UnixNano(), userId); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset, please log in"})
+}
+
+func main() {
+	// secret must come from env, a key in source lets anyone forge tokens
+	secret := os.Getenv("JWT_SECRET")
+	if len(secret) < 32 {
+		log.Fatal("JWT_SECRET must be set and at least 32 bytes long")
+	}
+	jwtKey = []byte(secret)
+	jwtTTL = getEnvDuration("JWT_TTL", jwtTTL)
+	log.Printf("issuing tokens valid for %s", jwtTTL)
+	if err := selfTestJWT(jwtKeyFunc); err != nil {
+		log.Fatal(err)
+	}
+
+	// DB_PATH -> sqlite file to use (":memory:" works too)
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		dbPath = "./notes.db"
+	}
+	var err error
+	db, err = sql.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configurePool()
+	if err := migrate(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := reconcileNoteCounts(); err != nil {
+		log.Fatal(err)
+	}
+
+	maxQueryParams = getEnvInt("MAX_QUERY_PARAMS", maxQueryParams)
+	maxRepeatedParam = getEnvInt("MAX_REPEATED_PARAM", maxRepeatedParam)
+	requestTimeout = getEnvDuration("REQUEST_TIMEOUT", requestTimeout)
+	shutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", shutdownTimeout)
+	loginRateLimit = max(getEnvInt("LOGIN_RATE_LIMIT", loginRateLimit), 1)
+	loginRateWindow = getEnvDuration("LOGIN_RATE_WINDOW", loginRateWindow)
+	trustProxy = getEnvBool("TRUST_PROXY", trustProxy)
+	if adminAllowNets, err = parseCIDRs(os.Getenv("ADMIN_ALLOW_CIDRS")); err != nil {
+		log.Fatalf("ADMIN_ALLOW_CIDRS: %v", err)
+	}
+	if adminDenyNets, err = parseCIDRs(os.Getenv("ADMIN_DENY_CIDRS")); err != nil {
+		log.Fatalf("ADMIN_DENY_CIDRS: %v", err)
+	}
+	runBackground(cleanupLoginAttempts)
+	maxPendingChallenges = getEnvInt("MAX_PENDING_CHALLENGES", maxPendingChallenges)
+	maxChallengesPerIP = getEnvInt("MAX_CHALLENGES_PER_IP", maxChallengesPerIP)
+	runBackground(cleanupChallenges)
+	byteQuota = int64(getEnvInt("STORAGE_QUOTA_BYTES", int(byteQuota)))
+	maxIntrospectBatch = getEnvInt("MAX_INTROSPECT_BATCH", maxIntrospectBatch)
+	introspectClientSecret = os.Getenv("INTROSPECT_CLIENT_SECRET")
+	switch mode := strings.ToLower(os.Getenv("SIGNUP_MODE")); mode {
+	case "":
+	case "open", "closed", "invite":
+		signupMode = mode
+	default:
+		log.Fatal("SIGNUP_MODE must be open, closed or invite")
+	}
+	if err := seedInviteCodes(os.Getenv("INVITE_CODES")); err != nil {
+		log.Fatal(err)
+	}
+	minPasswordLen = getEnvInt("MIN_PASSWORD_LEN", minPasswordLen)
+	devMode = getEnvBool("DEV_MODE", devMode)
+	bcryptCost = min(max(getEnvInt("BCRYPT_COST", bcryptCost), bcrypt.MinCost), bcrypt.MaxCost)
+	// low costs are only meant to make local runs and tests fast
+	if bcryptCost < 10 && !devMode {
+		slog.Warn("BCRYPT_COST below 10 makes password hashes cheap to brute force", "cost", bcryptCost)
+	}
+	if err := seedAdmin(); err != nil {
+		log.Fatal(err)
+	}
+	refreshGrace = getEnvDuration("REFRESH_GRACE", refreshGrace)
+	revokedTokenSweepInterval = getEnvDuration("REVOKED_TOKEN_SWEEP_INTERVAL", revokedTokenSweepInterval)
+	if revokedTokenSweepInterval <= 0 {
+		log.Fatal("REVOKED_TOKEN_SWEEP_INTERVAL must be positive")
+	}
+	runBackground(func(ctx context.Context) {
+		runRevokedTokenSweeper(ctx, revokedTokenSweepInterval)
+	})
+	maxRefreshWindow = getEnvDuration("REFRESH_MAX_WINDOW", maxRefreshWindow)
+	passwordResetTTL = getEnvDuration("PASSWORD_RESET_TTL", passwordResetTTL)
+	dbCheckTimeout = getEnvDuration("DB_CHECK_TIMEOUT", dbCheckTimeout)
+	importWorkers = max(1, getEnvInt("IMPORT_WORKERS", importWorkers))
+	startImportWorkers()
+	importJobTTL = getEnvDuration("IMPORT_JOB_TTL", importJobTTL)
+	runBackground(cleanupImportJobs)
+
+	//Router
+	r := mux.NewRouter()
+	setLogFormat(os.Getenv("LOG_FORMAT"))
+	parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	maxBodyBytes = int64(getEnvInt("MAX_BODY_BYTES", int(maxBodyBytes)))
+	r.Use(bodyLimitMiddleware)
+	r.Use(queryLimitMiddleware)
+	r.Use(timeoutMiddleware)
+	r.HandleFunc("/livez", livezHandler).Methods("GET")
+	r.HandleFunc("/healthz", livezHandler).Methods("GET") // same as /livez
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET")
+	// api routes are versioned, probes stay at the root for load balancers / k8s
+	v1 := r.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/signup", signupHandler).Methods("POST")
+	v1.Handle("/login", loginRateLimitMiddleware(http.HandlerFunc(loginHandler))).Methods("POST")
+	v1.HandleFunc("/refresh", refreshHandler).Methods("POST")
+	v1.Handle("/logout", authMiddleware(http.HandlerFunc(logoutHandler))).Methods("POST")
+	// share the per ip budget with /login
+	v1.Handle("/forgot-password", loginRateLimitMiddleware(http.HandlerFunc(forgotPasswordHandler))).Methods("POST")
+	v1.Handle("/reset-password", loginRateLimitMiddleware(http.HandlerFunc(resetPasswordHandler))).Methods("POST")
+	v1.HandleFunc("/capabilities", capabilitiesHandler).Methods("GET")
+	v1.HandleFunc("/auth/challenge", challengeHandler).Methods("GET")
+	v1.HandleFunc("/auth/challenge/verify", verifyChallengeHandler).Methods("POST")
+	v1.Handle("/auth/introspect-batch", introspectAuthMiddleware(http.HandlerFunc(introspectBatchHandler))).Methods("POST")
+	// protected routes
+	v1.Handle("/change-password", authMiddleware(http.HandlerFunc(changePasswordHandler))).Methods("POST")
+	v1.Handle("/notes", authMiddleware(http.HandlerFunc(createNoteHandler))).Methods("POST")
+	v1.Handle("/notes", authMiddleware(gzipMiddleware(http.HandlerFunc(getNotesHandler)))).Methods("GET")
+	v1.Handle("/notes/count", authMiddleware(http.HandlerFunc(countNotesHandler))).Methods("GET")
+	v1.Handle("/notes/on-this-day", authMiddleware(http.HandlerFunc(onThisDayHandler))).Methods("GET")
+	v1.Handle("/notes/import", authMiddleware(http.HandlerFunc(importNotesHandler))).Methods("POST")
+	v1.Handle("/notes/import/{jobId}", authMiddleware(http.HandlerFunc(importStatusHandler))).Methods("GET")
+	v1.Handle("/notes/by-title", authMiddleware(http.HandlerFunc(getNotesByTitleHandler))).Methods("GET")
+	v1.Handle("/notes/{id}", authMiddleware(http.HandlerFunc(getNoteHandler))).Methods("GET")
+	v1.Handle("/notes/{id}", authMiddleware(http.HandlerFunc(updateNoteHandler))).Methods("PUT")
+	v1.Handle("/notes/{id}", authMiddleware(http.HandlerFunc(deleteNoteHandler))).Methods("DELETE")
+	admin := v1.PathPrefix("/admin").Subrouter()
+	admin.Use(adminIPMiddleware)
+	admin.Handle("/notes", authMiddleware(requireRole("admin")(gzipMiddleware(http.HandlerFunc(adminNotesHandler))))).Methods("GET")
+	admin.Handle("/users", authMiddleware(requireRole("admin")(http.HandlerFunc(adminCreateUserHandler)))).Methods("POST")
+	admin.Handle("/db/check", authMiddleware(requireRole("admin")(http.HandlerFunc(adminDBCheckHandler)))).Methods("POST")
+	v1.Handle("/me", authMiddleware(http.HandlerFunc(meHandler))).Methods("GET")
+	v1.Handle("/me/content-schema", authMiddleware(http.HandlerFunc(putContentSchemaHandler))).Methods("PUT")
+	v1.Handle("/me/content-schema", authMiddleware(http.HandlerFunc(deleteContentSchemaHandler))).Methods("DELETE")
+	v1.Handle("/me/backup", authMiddleware(http.HandlerFunc(exportBackupHandler))).Methods("GET")
+	v1.Handle("/me/backup", authMiddleware(http.HandlerFunc(importBackupHandler))).Methods("POST")
+	v1.Handle("/me/keys", authMiddleware(http.HandlerFunc(addPublicKeyHandler))).Methods("POST")
+	v1.Handle("/me/stats", authMiddleware(http.HandlerFunc(statsHandler))).Methods("GET")
 
+	ready.Store(true)
+	fmt.Println("Server running on http://localhost:8080, api at /v1")
+	srv := &http.Server{Addr: ":8080", Handler: serverHandler(r)}
+	serve(srv)
 }
 
 //** NOTE-> After user login, server creates a token (jwt)
@@ -0,0 +1,1439 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fresh in-memory db with the real migrations and pool settings
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	jwtKey = []byte("0123456789abcdef0123456789abcdef")
+	bcryptCost = bcrypt.MinCost
+	var err error
+	db, err = sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configurePool()
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+}
+
+func createTestUser(t *testing.T, username, password string) int {
+	t.Helper()
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	res, err := db.Exec("INSERT INTO users (username, email, password_hash) VALUES (?, ?, ?)", username, username+"@example.com", string(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id)
+}
+
+// run h, fail instead of hanging when it blocks (e.g. waiting for the single pool conn)
+func serveWithin(t *testing.T, h http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h(rec, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s %s did not finish", req.Method, req.URL)
+	}
+	return rec
+}
+
+func TestChallengeLogin(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "alice", "secret123")
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := db.Exec("INSERT INTO user_keys (user_id, public_key) VALUES (?, ?)", userId, base64.StdEncoding.EncodeToString(pub)); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveWithin(t, challengeHandler, httptest.NewRequest("GET", "/auth/challenge?username=alice", nil))
+	var ch struct{ Nonce string }
+	json.NewDecoder(rec.Body).Decode(&ch)
+	if rec.Code != http.StatusOK || ch.Nonce == "" {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(ch.Nonce)))
+	body := `{"username":"alice","nonce":"` + ch.Nonce + `","signature":"` + sig + `"}`
+	rec = serveWithin(t, verifyChallengeHandler, httptest.NewRequest("POST", "/auth/challenge/verify", strings.NewReader(body)))
+	var resp struct{ Token string }
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Token == "" {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	claims, err := validateToken(resp.Token)
+	if err != nil || claims.UserId != userId || claims.Role != "user" {
+		t.Fatal(err, claims)
+	}
+
+	// nonce is single use
+	rec = serveWithin(t, verifyChallengeHandler, httptest.NewRequest("POST", "/auth/challenge/verify", strings.NewReader(body)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatal(rec.Code)
+	}
+}
+
+// opens a db file in t.TempDir, so migrate sees a db made by an older build
+func openTestDBFile(t *testing.T, schema string) {
+	t.Helper()
+	jwtKey = []byte("0123456789abcdef0123456789abcdef")
+	var err error
+	db, err = sql.Open("sqlite3", t.TempDir()+"/notes.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configurePool()
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// schema as created by the service before migrations existed
+const baselineSchema = `
+	CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE NOT NULL, password_hash TEXT NOT NULL);
+	CREATE TABLE notes (id INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT, content TEXT, user_id INTEGER, FOREIGN KEY(user_id) REFERENCES users(id));
+	INSERT INTO users (username, password_hash) VALUES ('old', 'x');
+	INSERT INTO notes (title, content, user_id) VALUES ('kept', 'from before', 1);
+`
+
+func TestMigrateBaselineDB(t *testing.T) {
+	openTestDBFile(t, baselineSchema)
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	// second start is a no-op
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	var changedAt int64
+	var email, role string
+	if err := db.QueryRow("SELECT password_changed_at, email, role FROM users WHERE username = 'old'").Scan(&changedAt, &email, &role); err != nil {
+		t.Fatal(err)
+	}
+	if changedAt != 0 || email != "" || role != "user" {
+		t.Fatal(changedAt, email, role)
+	}
+	var createdAt sql.NullString
+	if err := db.QueryRow("SELECT created_at FROM notes WHERE title = 'kept'").Scan(&createdAt); err != nil || !createdAt.Valid {
+		t.Fatal(err, createdAt)
+	}
+	for _, table := range []string{"invite_codes", "user_keys", "note_counts", "content_schemas", "password_resets"} {
+		if _, err := db.Exec("SELECT COUNT(*) FROM " + table); err != nil {
+			t.Fatal(table, err)
+		}
+	}
+	// tokens of the old user validate, which reads password_changed_at
+	tok, _ := issueToken(1, "user")
+	if _, err := validateToken(tok); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a migration that fails stops migrate and is not recorded, so the next start tries it again
+func TestMigrateFailsHard(t *testing.T) {
+	openTestDBFile(t, baselineSchema)
+	all := migrations
+	migrations = append(slices.Clone(all), migration{len(all) + 1, "ALTER TABLE missing ADD COLUMN x TEXT"})
+	defer func() { migrations = all }()
+	if err := migrate(db); err == nil {
+		t.Fatal("migrate succeeded with a failing migration")
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = ?", len(all)+1).Scan(&n)
+	if n != 0 {
+		t.Fatal("failed migration was recorded")
+	}
+}
+
+// request as seen by a handler behind authMiddleware
+func withUser(req *http.Request, userId int, role string) *http.Request {
+	ctx := context.WithValue(req.Context(), userIDKey, userId)
+	return req.WithContext(context.WithValue(ctx, roleKey, role))
+}
+
+func TestChangePasswordRevokesOldTokens(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "alice", "secret123")
+	sign := func(c *Claims) string {
+		tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(jwtKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	before := testClaims(userId)
+	before.IssuedAt -= 10
+	old := sign(before)
+	noIat := testClaims(userId)
+	noIat.IssuedAt = 0
+	noIatStr := sign(noIat)
+
+	body := `{"old_password":"secret123","new_password":"newsecret456"}`
+	rec := httptest.NewRecorder()
+	changePasswordHandler(rec, withUser(httptest.NewRequest("POST", "/change-password", strings.NewReader(body)), userId, "user"))
+	var resp struct{ Token string }
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Token == "" {
+		t.Fatal(rec.Code)
+	}
+	if _, err := validateToken(old); err != errTokenRevoked {
+		t.Fatalf("token from before the change: %v, want revoked", err)
+	}
+	if _, err := validateToken(noIatStr); !errors.Is(err, errTokenNoIssuedAt) {
+		t.Fatalf("token without iat: %v, want errTokenNoIssuedAt", err)
+	}
+	// returned token is from the same second as the change
+	if _, err := validateToken(resp.Token); err != nil {
+		t.Fatal(err)
+	}
+	// change an hour ago, a token issued now is after it
+	if _, err := db.Exec("UPDATE users SET password_changed_at = ? WHERE id = ?", time.Now().Add(-time.Hour).UnixNano(), userId); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := issueToken(userId, "user")
+	if _, err := validateToken(after); err != nil {
+		t.Fatalf("token issued after the change: %v", err)
+	}
+}
+
+func onThisDay(t *testing.T, userId int, query string) []Note {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	onThisDayHandler(rec, withUser(httptest.NewRequest("GET", "/notes/on-this-day?"+query, nil), userId, "user"))
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	var notes []Note
+	json.NewDecoder(rec.Body).Decode(&notes)
+	return notes
+}
+
+func noteTitles(notes []Note) string {
+	var titles []string
+	for _, n := range notes {
+		titles = append(titles, n.Title)
+	}
+	return strings.Join(titles, ",")
+}
+
+func TestOnThisDay(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestUser(t, "alice", "secret123")
+	bob := createTestUser(t, "bob", "secret123")
+	seed := []struct {
+		user      int
+		title     string
+		createdAt string
+	}{
+		{alice, "2021", "2021-03-05 09:00:00"},
+		{alice, "2019", "2019-03-05 23:59:59"},
+		{alice, "next day", "2021-03-06 00:00:00"},
+		{bob, "bob 2020", "2020-03-05 12:00:00"},
+		{alice, "leap", "2020-02-29 10:00:00"},
+		{alice, "feb 28", "2022-02-28 10:00:00"},
+	}
+	for _, s := range seed {
+		if _, err := db.Exec("INSERT INTO notes (title, content, user_id, created_at) VALUES (?, '', ?, ?)", s.title, s.user, s.createdAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		date string
+		want string
+	}{
+		{"2023-03-05", "2019,2021"},
+		{"2023-02-28", "leap,feb 28"}, // non leap year: Feb 29 notes show up on the 28th
+		{"2024-02-28", "feb 28"},      // leap year has its own Feb 29
+		{"2024-02-29", "leap"},
+		{"2023-07-01", ""},
+	}
+	for _, tt := range tests {
+		if got := noteTitles(onThisDay(t, alice, "date="+tt.date)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.date, got, tt.want)
+		}
+	}
+	rec := httptest.NewRecorder()
+	onThisDayHandler(rec, withUser(httptest.NewRequest("GET", "/notes/on-this-day?date=03-05", nil), alice, "user"))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal(rec.Code)
+	}
+}
+
+// db from before created_at existed: old notes get the upgrade time, new ones their insert time
+func TestOnThisDayUpgradedDB(t *testing.T) {
+	openTestDBFile(t, baselineSchema)
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	body := `{"title":"new","content":"after upgrade"}`
+	createNoteHandler(rec, withUser(httptest.NewRequest("POST", "/notes", strings.NewReader(body)), 1, "user"))
+	if rec.Code/100 != 2 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if got := noteTitles(onThisDay(t, 1, "")); got != "kept,new" {
+		t.Fatal(got)
+	}
+}
+
+func postJSON(h http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminCreateUser(t *testing.T) {
+	setupTestDB(t)
+	adminId := createTestUser(t, "root", "rootpass1")
+	admin := requireRole("admin")(http.HandlerFunc(adminCreateUserHandler)).ServeHTTP
+	defer func(mode string) { signupMode = mode }(signupMode)
+
+	for i, mode := range []string{"open", "closed", "invite"} {
+		t.Run(mode, func(t *testing.T) {
+			signupMode = mode
+			username := fmt.Sprintf("made%d", i)
+			body := fmt.Sprintf(`{"username":%q,"email":"%s@example.com","password":"secret123"}`, username, username)
+
+			// normal signup follows the mode, no invite code is sent
+			signup := postJSON(signupHandler, httptest.NewRequest("POST", "/v1/signup", strings.NewReader(body)))
+			if want := map[string]int{"open": http.StatusCreated, "closed": http.StatusForbidden, "invite": http.StatusForbidden}[mode]; signup.Code != want {
+				t.Fatalf("signup = %d, want %d: %s", signup.Code, want, signup.Body.String())
+			}
+			if signup.Code == http.StatusCreated {
+				username += "b"
+				body = fmt.Sprintf(`{"username":%q,"email":"%s@example.com","password":"secret123","role":"admin"}`, username, username)
+			}
+
+			rec := postJSON(admin, withUser(httptest.NewRequest("POST", "/v1/admin/users", strings.NewReader(body)), adminId, "admin"))
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("admin create = %d: %s", rec.Code, rec.Body.String())
+			}
+			var created struct {
+				Id   int    `json:"id"`
+				Role string `json:"role"`
+			}
+			json.NewDecoder(rec.Body).Decode(&created)
+			wantRole := "user"
+			if strings.HasSuffix(username, "b") {
+				wantRole = "admin"
+			}
+			if role, err := userRole(created.Id); err != nil || role != wantRole || created.Role != wantRole {
+				t.Fatalf("created role = %q/%q (%v), want %q", role, created.Role, err, wantRole)
+			}
+			// the new account can log in
+			login := postJSON(loginHandler, httptest.NewRequest("POST", "/v1/login", strings.NewReader(fmt.Sprintf(`{"username":%q,"password":"secret123"}`, username))))
+			if login.Code != http.StatusOK {
+				t.Fatalf("login as created user = %d: %s", login.Code, login.Body.String())
+			}
+		})
+	}
+
+	body := `{"username":"nope","email":"nope@example.com","password":"secret123"}`
+	if rec := postJSON(admin, withUser(httptest.NewRequest("POST", "/v1/admin/users", strings.NewReader(body)), adminId, "user")); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin create = %d, want 403", rec.Code)
+	}
+	body = `{"username":"made0","email":"other@example.com","password":"secret123"}`
+	if rec := postJSON(admin, withUser(httptest.NewRequest("POST", "/v1/admin/users", strings.NewReader(body)), adminId, "admin")); rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate username = %d, want 409", rec.Code)
+	}
+	body = `{"username":"x","email":"x@example.com","password":"secret123","role":"owner"}`
+	if rec := postJSON(admin, withUser(httptest.NewRequest("POST", "/v1/admin/users", strings.NewReader(body)), adminId, "admin")); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown role = %d, want 400", rec.Code)
+	}
+}
+
+func TestInviteSignup(t *testing.T) {
+	setupTestDB(t)
+	defer func(mode string) { signupMode = mode }(signupMode)
+	signupMode = "invite"
+	if err := seedInviteCodes("abc"); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"username":"inv","email":"inv@example.com","password":"secret123","invite_code":"abc"}`
+	if rec := postJSON(signupHandler, httptest.NewRequest("POST", "/v1/signup", strings.NewReader(body))); rec.Code != http.StatusCreated {
+		t.Fatalf("signup with code = %d: %s", rec.Code, rec.Body.String())
+	}
+	// one code, one account
+	body = `{"username":"inv2","email":"inv2@example.com","password":"secret123","invite_code":"abc"}`
+	if rec := postJSON(signupHandler, httptest.NewRequest("POST", "/v1/signup", strings.NewReader(body))); rec.Code != http.StatusForbidden {
+		t.Fatalf("reused code = %d, want 403", rec.Code)
+	}
+}
+
+func TestSelfTestJWT(t *testing.T) {
+	setupTestDB(t)
+	if err := selfTestJWT(jwtKeyFunc); err != nil {
+		t.Fatalf("matching keys: %v", err)
+	}
+	// verifier holding a different key than the signer
+	otherKey := func(*jwt.Token) (interface{}, error) { return []byte("a-completely-different-secret-key"), nil }
+	if err := selfTestJWT(otherKey); err == nil {
+		t.Fatal("mismatched keys passed the self-test")
+	}
+	// verifier expecting another algorithm
+	rsaOnly := func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return nil, nil
+	}
+	if err := selfTestJWT(rsaOnly); err == nil {
+		t.Fatal("algorithm mismatch passed the self-test")
+	}
+}
+
+// status of a request to a route behind authMiddleware
+func authStatus(t *testing.T, tokenStr string) int {
+	t.Helper()
+	h := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("GET", "/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func testClaims(userId int) *Claims {
+	now := time.Now()
+	return &Claims{UserId: userId, Role: "user", AuthTime: now.Unix(), StandardClaims: jwt.StandardClaims{
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+	}}
+}
+
+func TestAuthRejectsOtherAlgorithms(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "alice", "password1")
+
+	good, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims(userId)).SignedString(jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authStatus(t, good); code != http.StatusOK {
+		t.Fatalf("HS256 token = %d, want 200", code)
+	}
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims(userId)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authStatus(t, none); code != http.StatusUnauthorized {
+		t.Fatalf("alg none token = %d, want 401", code)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := jwt.NewWithClaims(jwt.SigningMethodRS256, testClaims(userId)).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authStatus(t, rs); code != http.StatusUnauthorized {
+		t.Fatalf("RS256 token = %d, want 401", code)
+	}
+}
+
+func TestAuthRejectsFutureTokens(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "alice", "password1")
+	future := time.Now().Add(time.Hour).Unix()
+
+	sign := func(c *Claims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(jwtKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	// signed with the real key, so only the claim check can stop them
+	iat := testClaims(userId)
+	iat.IssuedAt = future
+	if code := authStatus(t, sign(iat)); code != http.StatusUnauthorized {
+		t.Fatalf("future iat = %d, want 401", code)
+	}
+	nbf := testClaims(userId)
+	nbf.NotBefore = future
+	if code := authStatus(t, sign(nbf)); code != http.StatusUnauthorized {
+		t.Fatalf("future nbf = %d, want 401", code)
+	}
+
+	// iat edited in a valid token without re-signing
+	parts := strings.Split(sign(testClaims(userId)), ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]any
+	json.Unmarshal(payload, &claims)
+	claims["iat"] = future
+	payload, _ = json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	if code := authStatus(t, strings.Join(parts, ".")); code != http.StatusUnauthorized {
+		t.Fatalf("tampered iat = %d, want 401", code)
+	}
+
+	// and tokens from signToken carry iat and nbf
+	tokenStr, err := issueToken(userId, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := validateToken(tokenStr)
+	if err != nil || c.IssuedAt == 0 || c.NotBefore == 0 {
+		t.Fatalf("issued token claims %+v, %v", c, err)
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	setupTestDB(t)
+	createTestUser(t, "alice", "password1")
+	loginAttempts.byIP = map[string][]time.Time{}
+	t.Cleanup(func() { loginAttempts.byIP = map[string][]time.Time{} })
+	h := loginRateLimitMiddleware(http.HandlerFunc(loginHandler))
+	login := func(remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/login", strings.NewReader(`{"username":"alice","password":"wrong-pass1"}`))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < loginRateLimit; i++ {
+		if rec := login("10.0.0.1:1234"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d = %d, want 401", i+1, rec.Code)
+		}
+	}
+	// other port, same ip: still the same bucket
+	rec := login("10.0.0.1:5678")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("attempt over the limit = %d, want 429", rec.Code)
+	}
+	if ra, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || ra <= 0 || ra > int(loginRateWindow/time.Second) {
+		t.Fatalf("Retry-After = %q", rec.Header().Get("Retry-After"))
+	}
+	if rec := login("10.0.0.2:1234"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("other ip = %d, want 401", rec.Code)
+	}
+	// once the window has passed the ip may try again
+	if wait := allowLogin("10.0.0.1", time.Now().Add(loginRateWindow)); wait != 0 {
+		t.Fatalf("after the window still waiting %s", wait)
+	}
+}
+
+func signup(body string) *httptest.ResponseRecorder {
+	return postJSON(signupHandler, httptest.NewRequest("POST", "/v1/signup", strings.NewReader(body)))
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	setupTestDB(t)
+	tests := []struct {
+		name     string
+		password string
+		failed   []string
+	}{
+		{"too short", "abc12", []string{"must be at least 8 characters"}},
+		{"all letters", "abcdefghij", []string{"must contain a digit"}},
+		{"all digits", "1234567890", []string{"must contain a letter"}},
+		{"valid", "abcdefg1", nil},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPasswordPolicy(tt.password); strings.Join(got, ";") != strings.Join(tt.failed, ";") {
+				t.Fatalf("checkPasswordPolicy(%q) = %v, want %v", tt.password, got, tt.failed)
+			}
+			rec := signup(fmt.Sprintf(`{"username":"u%d","email":"u%d@example.com","password":%q}`, i, i, tt.password))
+			if tt.failed == nil {
+				if rec.Code != http.StatusCreated {
+					t.Fatalf("signup = %d: %s", rec.Code, rec.Body.String())
+				}
+				return
+			}
+			var body struct {
+				Error       string   `json:"error"`
+				FailedRules []string `json:"failed_rules"`
+			}
+			json.NewDecoder(rec.Body).Decode(&body)
+			if rec.Code != http.StatusBadRequest || strings.Join(body.FailedRules, ";") != strings.Join(tt.failed, ";") {
+				t.Fatalf("signup = %d %+v, want 400 listing %v", rec.Code, body, tt.failed)
+			}
+		})
+	}
+
+	defer func(n int) { minPasswordLen = n }(minPasswordLen)
+	minPasswordLen = 12
+	if got := checkPasswordPolicy("abcdefg1"); len(got) != 1 {
+		t.Fatalf("with MIN_PASSWORD_LEN 12: %v", got)
+	}
+}
+
+func TestSignupDuplicateUsername(t *testing.T) {
+	setupTestDB(t)
+	if rec := signup(`{"username":"bob","email":"bob@example.com","password":"secret123"}`); rec.Code != http.StatusCreated {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	rec := signup(`{"username":"bob","email":"bob2@example.com","password":"secret123"}`)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "username already taken") {
+		t.Fatalf("second signup = %d %s, want 409 username already taken", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSignupEmail(t *testing.T) {
+	setupTestDB(t)
+	rec := signup(`{"username":"carol","email":" Carol@Example.com ","password":"secret123"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	var stored string
+	db.QueryRow("SELECT email FROM users WHERE username = 'carol'").Scan(&stored)
+	if stored != "carol@example.com" {
+		t.Fatalf("stored email %q, want carol@example.com", stored)
+	}
+	// login by email works too
+	login := postJSON(loginHandler, httptest.NewRequest("POST", "/v1/login", strings.NewReader(`{"email":"carol@example.com","password":"secret123"}`)))
+	if login.Code != http.StatusOK {
+		t.Fatalf("login by email = %d: %s", login.Code, login.Body.String())
+	}
+
+	for _, email := range []string{"", "not-an-email", "Carol <carol2@example.com>", "a@"} {
+		rec := signup(fmt.Sprintf(`{"username":"dave","email":%q,"password":"secret123"}`, email))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("email %q = %d, want 400", email, rec.Code)
+		}
+	}
+
+	// same address in another case is still a duplicate, and reported as the email
+	rec = signup(`{"username":"carol2","email":"CAROL@example.com","password":"secret123"}`)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "email already registered") {
+		t.Fatalf("duplicate email = %d %s, want 409 email already registered", rec.Code, rec.Body.String())
+	}
+}
+
+func resetChallenges(t *testing.T) {
+	challengesMu.Lock()
+	challenges, challengesByIP = make(map[string]challenge), make(map[string]int)
+	challengesMu.Unlock()
+	t.Cleanup(func() {
+		challengesMu.Lock()
+		challenges, challengesByIP = make(map[string]challenge), make(map[string]int)
+		challengesMu.Unlock()
+	})
+}
+
+func getChallenge(remote string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/auth/challenge?username=alice", nil)
+	req.RemoteAddr = remote
+	rec := httptest.NewRecorder()
+	challengeHandler(rec, req)
+	return rec
+}
+
+func TestChallengeLimits(t *testing.T) {
+	setupTestDB(t)
+	resetChallenges(t)
+	for i := 0; i < maxChallengesPerIP; i++ {
+		if rec := getChallenge("10.0.0.1:1000"); rec.Code != http.StatusOK {
+			t.Fatalf("challenge %d = %d", i+1, rec.Code)
+		}
+	}
+	rec := getChallenge("10.0.0.1:2000")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("over the per-ip cap = %d (Retry-After %q), want 429", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := getChallenge("10.0.0.2:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("other ip = %d, want 200", rec.Code)
+	}
+
+	// a used nonce frees its slot
+	var ch struct{ Nonce string }
+	json.NewDecoder(getChallenge("10.0.0.3:1000").Body).Decode(&ch)
+	for i := 1; i < maxChallengesPerIP; i++ {
+		getChallenge("10.0.0.3:1000")
+	}
+	body := `{"username":"alice","nonce":"` + ch.Nonce + `","signature":"AAAA"}`
+	verifyChallengeHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/auth/challenge/verify", strings.NewReader(body)))
+	if rec := getChallenge("10.0.0.3:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("after a nonce was used = %d, want 200", rec.Code)
+	}
+
+	// the sweeper drops expired ones and their per-ip counts
+	sweepChallenges(time.Now().Add(challengeTTL + time.Second))
+	challengesMu.Lock()
+	pending, ips := len(challenges), len(challengesByIP)
+	challengesMu.Unlock()
+	if pending != 0 || ips != 0 {
+		t.Fatalf("after sweep %d challenges, %d ips left", pending, ips)
+	}
+	if rec := getChallenge("10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("after sweep = %d, want 200", rec.Code)
+	}
+
+	// cap for everyone together
+	defer func(n int) { maxPendingChallenges = n }(maxPendingChallenges)
+	maxPendingChallenges = 1
+	if rec := getChallenge("10.0.0.9:1000"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the global cap = %d, want 429", rec.Code)
+	}
+}
+
+func TestIntrospectRequiresCaller(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "alice", "password1")
+	adminId := createTestUser(t, "root", "password1")
+	userToken, _ := issueToken(userId, "user")
+	adminToken, _ := issueToken(adminId, "admin")
+	defer func(s string) { introspectClientSecret = s }(introspectClientSecret)
+	introspectClientSecret = "gateway-secret-0123456789"
+
+	h := introspectAuthMiddleware(http.HandlerFunc(introspectBatchHandler))
+	body := `{"tokens":["` + userToken + `"]}`
+	tests := []struct {
+		name   string
+		auth   string
+		status int
+	}{
+		{"no credentials", "", http.StatusUnauthorized},
+		{"user token", "Bearer " + userToken, http.StatusForbidden},
+		{"wrong secret", "Bearer not-the-secret", http.StatusUnauthorized},
+		{"admin token", "Bearer " + adminToken, http.StatusOK},
+		{"client secret", "Bearer " + introspectClientSecret, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/auth/introspect-batch", strings.NewReader(body))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if rec.Code == http.StatusOK && !strings.Contains(rec.Body.String(), `"active":true`) {
+				t.Fatalf("body %s", rec.Body.String())
+			}
+		})
+	}
+
+	// without a configured secret only admins get in, an empty bearer never matches
+	introspectClientSecret = ""
+	req := httptest.NewRequest("POST", "/v1/auth/introspect-batch", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("no secret configured, no credentials = %d, want 401", rec.Code)
+	}
+}
+
+func importStatus(t *testing.T, userId int, jobId string) importJob {
+	t.Helper()
+	req := mux.SetURLVars(withUser(httptest.NewRequest("GET", "/v1/notes/import/"+jobId, nil), userId, "user"), map[string]string{"jobId": jobId})
+	rec := httptest.NewRecorder()
+	importStatusHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status of job %s = %d: %s", jobId, rec.Code, rec.Body.String())
+	}
+	var job importJob
+	json.NewDecoder(rec.Body).Decode(&job)
+	return job
+}
+
+func TestImportJobLifecycle(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "alice", "password1")
+	// queue without workers, the test runs the job itself
+	defer func(q chan *importJob) { importQueue = q }(importQueue)
+	importQueue = make(chan *importJob, 1)
+
+	body := `[{"title":"a","content":"1"},{"title":"b","content":"2"}]`
+	rec := httptest.NewRecorder()
+	importNotesHandler(rec, withUser(httptest.NewRequest("POST", "/v1/notes/import", strings.NewReader(body)), userId, "user"))
+	var resp struct {
+		JobId string `json:"job_id"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusAccepted || resp.JobId == "" {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if job := importStatus(t, userId, resp.JobId); job.Status != "queued" || job.Total != 2 {
+		t.Fatalf("before a worker picked it up: %+v", job)
+	}
+
+	// hold the only pool conn so the job blocks on its first note while running
+	hold, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		runImportJob(context.Background(), <-importQueue)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for importStatus(t, userId, resp.JobId).Status != "running" {
+		if time.Now().After(deadline) {
+			t.Fatal("job never started running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hold.Rollback()
+	<-done
+	if job := importStatus(t, userId, resp.JobId); job.Status != "done" || job.Imported != 2 || job.Failed != 0 {
+		t.Fatalf("finished job: %+v", job)
+	}
+
+	// other users can't see it
+	req := mux.SetURLVars(withUser(httptest.NewRequest("GET", "/", nil), userId+1, "user"), map[string]string{"jobId": resp.JobId})
+	rec = httptest.NewRecorder()
+	importStatusHandler(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("other user = %d, want 404", rec.Code)
+	}
+
+	// kept until the ttl is over, then evicted
+	sweepImportJobs(time.Now())
+	importStatus(t, userId, resp.JobId)
+	sweepImportJobs(time.Now().Add(importJobTTL))
+	importJobsMu.Lock()
+	_, found := importJobs[resp.JobId]
+	importJobsMu.Unlock()
+	if found {
+		t.Fatal("done job still there after its ttl")
+	}
+}
+
+func TestSweepKeepsUnfinishedImports(t *testing.T) {
+	importJobsMu.Lock()
+	importJobs["q"] = &importJob{ID: "q", Status: "queued"}
+	importJobs["r"] = &importJob{ID: "r", Status: "running"}
+	importJobsMu.Unlock()
+	t.Cleanup(func() {
+		importJobsMu.Lock()
+		delete(importJobs, "q")
+		delete(importJobs, "r")
+		importJobsMu.Unlock()
+	})
+	sweepImportJobs(time.Now().Add(10 * importJobTTL))
+	importJobsMu.Lock()
+	defer importJobsMu.Unlock()
+	if importJobs["q"] == nil || importJobs["r"] == nil {
+		t.Fatal("sweep removed a job that isn't done")
+	}
+}
+
+func TestLogoutRevokesToken(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "alice", "password1")
+	tokenStr, _ := issueToken(userId, "user")
+	other, _ := issueToken(userId, "user")
+
+	req := httptest.NewRequest("POST", "/v1/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	rec := httptest.NewRecorder()
+	authMiddleware(http.HandlerFunc(logoutHandler)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if code := authStatus(t, tokenStr); code != http.StatusUnauthorized {
+		t.Fatalf("logged out token = %d, want 401", code)
+	}
+	req = httptest.NewRequest("POST", "/v1/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	if rec := postJSON(refreshHandler, req); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh with logged out token = %d, want 401", rec.Code)
+	}
+	// only that token is gone, not the whole session of the user
+	if code := authStatus(t, other); code != http.StatusOK {
+		t.Fatalf("other token = %d, want 200", code)
+	}
+	// only the hash is stored
+	var stored string
+	db.QueryRow("SELECT token_hash FROM revoked_tokens").Scan(&stored)
+	if stored != hashToken(tokenStr) {
+		t.Fatalf("stored %q", stored)
+	}
+}
+
+func TestSweepRevokedTokens(t *testing.T) {
+	setupTestDB(t)
+	now := time.Now()
+	db.Exec("INSERT INTO revoked_tokens (token_hash, expires_at) VALUES ('expired', ?), ('live', ?)", now.Add(-time.Minute).Unix(), now.Add(time.Hour).Unix())
+	if n, err := sweepRevokedTokens(now); err != nil || n != 1 {
+		t.Fatalf("swept %d, %v, want 1", n, err)
+	}
+	var left []string
+	rows, _ := db.Query("SELECT token_hash FROM revoked_tokens")
+	for rows.Next() {
+		var h string
+		rows.Scan(&h)
+		left = append(left, h)
+	}
+	rows.Close()
+	if strings.Join(left, ",") != "live" {
+		t.Fatalf("left after sweep: %v", left)
+	}
+
+	// the loop sweeps on its own and returns once stopped
+	db.Exec("INSERT INTO revoked_tokens (token_hash, expires_at) VALUES ('expired', ?)", now.Add(-time.Minute).Unix())
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runRevokedTokenSweeper(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM revoked_tokens WHERE token_hash = 'expired'").Scan(&n)
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sweeper never removed the expired entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sweeper did not stop")
+	}
+}
+
+// while draining, requests get 503 + Retry-After, probes still answer
+func TestShutdownRejectsNewRequests(t *testing.T) {
+	setupTestDB(t)
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", livezHandler)
+	r.HandleFunc("/capabilities", capabilitiesHandler)
+	h := serverHandler(r)
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/capabilities", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("during shutdown: %d, Retry-After %q, want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("probe during shutdown = %d, want 200", rec.Code)
+	}
+	shuttingDown.Store(false)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/capabilities", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("before shutdown = %d, want 200", rec.Code)
+	}
+}
+
+// serve's shutdown cancels every background worker and waits until they returned
+func TestBackgroundWorkersStopOnShutdown(t *testing.T) {
+	setupTestDB(t)
+	defer func(ctx context.Context, cancel context.CancelFunc, q chan *importJob) {
+		backgroundCtx, stopBackground, importQueue = ctx, cancel, q
+	}(backgroundCtx, stopBackground, importQueue)
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+
+	startImportWorkers()
+	runBackground(cleanupChallenges)
+	runBackground(cleanupLoginAttempts)
+	runBackground(cleanupImportJobs)
+	observed := make(chan error, 1)
+	runBackground(func(ctx context.Context) {
+		<-ctx.Done()
+		observed <- ctx.Err()
+	})
+
+	if !stopBackgroundWorkers(5 * time.Second) {
+		t.Fatal("background workers did not stop")
+	}
+	select {
+	case err := <-observed:
+		if err != context.Canceled {
+			t.Fatalf("worker saw %v, want context.Canceled", err)
+		}
+	default:
+		t.Fatal("worker returned without seeing the cancellation")
+	}
+	// workers are gone, a job queued now stays queued
+	job := &importJob{Status: "queued"}
+	importQueue <- job
+	time.Sleep(20 * time.Millisecond)
+	importJobsMu.Lock()
+	status := job.Status
+	importJobsMu.Unlock()
+	if status != "queued" {
+		t.Fatalf("job picked up after shutdown: %s", status)
+	}
+}
+
+func TestAdminDBCheck(t *testing.T) {
+	setupTestDB(t)
+	rec := httptest.NewRecorder()
+	adminDBCheckHandler(rec, withUser(httptest.NewRequest("POST", "/v1/admin/db/check", nil), 1, "admin"))
+	var resp struct {
+		OK     bool     `json:"ok"`
+		Result []string `json:"result"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, err)
+	}
+	if !resp.OK || len(resp.Result) != 1 || resp.Result[0] != "ok" {
+		t.Fatalf("healthy db: %+v", resp)
+	}
+	// admins only
+	h := authMiddleware(requireRole("admin")(http.HandlerFunc(adminDBCheckHandler)))
+	userId := createTestUser(t, "alice", "password1")
+	tok, _ := issueToken(userId, "user")
+	req := httptest.NewRequest("POST", "/v1/admin/db/check", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin = %d, want 403", rec.Code)
+	}
+}
+
+func TestAdminIPAllowlist(t *testing.T) {
+	defer func(allow, deny []*net.IPNet, trust bool) {
+		adminAllowNets, adminDenyNets, trustProxy = allow, deny, trust
+	}(adminAllowNets, adminDenyNets, trustProxy)
+	var err error
+	if adminAllowNets, err = parseCIDRs("10.0.0.0/8, 192.168.1.7"); err != nil {
+		t.Fatal(err)
+	}
+	if adminDenyNets, err = parseCIDRs("10.0.0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseCIDRs("10.0.0.0/33"); err == nil {
+		t.Fatal("bad cidr accepted")
+	}
+	r := mux.NewRouter()
+	admin := r.PathPrefix("/v1/admin").Subrouter()
+	admin.Use(adminIPMiddleware)
+	admin.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	for _, tc := range []struct {
+		remote, xff string
+		trust       bool
+		want        int
+	}{
+		{"10.1.2.3:1234", "", false, http.StatusOK},
+		{"192.168.1.7:1234", "", false, http.StatusOK},
+		{"10.0.0.5:1234", "", false, http.StatusForbidden},    // on the denylist
+		{"192.168.1.8:1234", "", false, http.StatusForbidden}, // not allowed
+		// behind the proxy the forwarded address counts, not the proxy's own
+		{"127.0.0.1:1234", "10.1.2.3", true, http.StatusOK},
+		{"10.1.2.3:1234", "8.8.8.8", true, http.StatusForbidden},
+		{"10.1.2.3:1234", "8.8.8.8", false, http.StatusOK},
+	} {
+		trustProxy = tc.trust
+		req := httptest.NewRequest("GET", "/v1/admin/ping", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s (xff %q, trust %v) = %d, want %d", tc.remote, tc.xff, tc.trust, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestIntrospectBatchResults(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "alice", "password1")
+	valid, _ := issueToken(userId, "user")
+	old := testClaims(userId)
+	old.IssuedAt -= 7200
+	old.NotBefore -= 7200
+	old.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, old).SignedString(jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, _ := issueToken(userId, "user")
+	if _, err := db.Exec("INSERT INTO revoked_tokens (token_hash, expires_at) VALUES (?, ?)", hashToken(revoked), time.Now().Add(time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string][]string{"tokens": {valid, expired, revoked, "garbage"}})
+	rec := postJSON(introspectBatchHandler, httptest.NewRequest("POST", "/v1/auth/introspect-batch", strings.NewReader(string(body))))
+	var resp struct{ Results []introspection }
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, err)
+	}
+	want := []introspection{
+		{Active: true, UserID: userId},
+		{UserID: userId, Error: "expired"},
+		{UserID: userId, Error: "revoked"},
+		{Error: "invalid"},
+	}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(resp.Results), len(want))
+	}
+	for i, got := range resp.Results {
+		got.ExpiresAt = 0
+		if got != want[i] {
+			t.Errorf("token %d: %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+// a panicking handler gets a json 500, the server keeps serving the next requests
+func TestPanicRecovered(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	r.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	srv := httptest.NewServer(serverHandler(r))
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/panic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]string
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Content-Type") != "application/json" || body["error"] == "" {
+			t.Fatalf("panic = %d %q %v, want json 500", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+		resp, err = http.Get(srv.URL + "/ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("after a panic = %d, want 200", resp.StatusCode)
+		}
+	}
+}
+
+func createUserNote(t *testing.T, userId int, title, content string) {
+	t.Helper()
+	body := fmt.Sprintf(`{"title":%q,"content":%q}`, title, content)
+	rec := httptest.NewRecorder()
+	createNoteHandler(rec, withUser(httptest.NewRequest("POST", "/v1/notes", strings.NewReader(body)), userId, "user"))
+	if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+}
+
+func userNoteTitles(t *testing.T, userId int) string {
+	t.Helper()
+	rows, err := db.Query("SELECT title FROM notes WHERE user_id = ? ORDER BY title", userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var titles []string
+	for rows.Next() {
+		var title string
+		rows.Scan(&title)
+		titles = append(titles, title)
+	}
+	return strings.Join(titles, ",")
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestUser(t, "alice", "password1")
+	bob := createTestUser(t, "bob", "password1")
+	createUserNote(t, alice, "first", "secret text")
+	createUserNote(t, alice, "second", "more")
+
+	req := httptest.NewRequest("GET", "/v1/me/backup", nil)
+	req.Header.Set("X-Backup-Passphrase", "correct horse")
+	rec := httptest.NewRecorder()
+	exportBackupHandler(rec, withUser(req, alice, "user"))
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	blob := rec.Body.Bytes()
+	if strings.Contains(string(blob), "secret text") {
+		t.Fatal("backup holds the note in plain text")
+	}
+	restore := func(passphrase string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/me/backup", strings.NewReader(string(blob)))
+		req.Header.Set("X-Backup-Passphrase", passphrase)
+		rec := httptest.NewRecorder()
+		importBackupHandler(rec, withUser(req, bob, "user"))
+		return rec
+	}
+
+	if rec := restore("wrong horse"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("wrong passphrase = %d, want 400", rec.Code)
+	}
+	if got := userNoteTitles(t, bob); got != "" {
+		t.Fatalf("notes imported with a wrong passphrase: %s", got)
+	}
+	rec = restore("correct horse")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"imported":2`) {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if got := userNoteTitles(t, bob); got != "first,second" {
+		t.Fatalf("restored notes = %q, want first,second", got)
+	}
+}
+
+func TestNoteCountMatchesCount(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestUser(t, "alice", "password1")
+	bob := createTestUser(t, "bob", "password1")
+	check := func(userId int) {
+		t.Helper()
+		var want int
+		if err := db.QueryRow("SELECT COUNT(*) FROM notes WHERE user_id = ?", userId).Scan(&want); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		countNotesHandler(rec, withUser(httptest.NewRequest("GET", "/v1/notes/count", nil), userId, "user"))
+		if body := fmt.Sprintf(`{"count":%d}`, want); strings.TrimSpace(rec.Body.String()) != body {
+			t.Fatalf("count = %s, want %s", rec.Body.String(), body)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		createUserNote(t, alice, fmt.Sprintf("note %d", i), "text")
+	}
+	check(alice)
+
+	var id int
+	db.QueryRow("SELECT id FROM notes WHERE user_id = ? LIMIT 1", alice).Scan(&id)
+	req := mux.SetURLVars(withUser(httptest.NewRequest("DELETE", "/v1/notes/"+strconv.Itoa(id), nil), alice, "user"), map[string]string{"id": strconv.Itoa(id)})
+	rec := httptest.NewRecorder()
+	deleteNoteHandler(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	check(alice)
+
+	req = httptest.NewRequest("GET", "/v1/me/backup", nil)
+	req.Header.Set("X-Backup-Passphrase", "pass")
+	rec = httptest.NewRecorder()
+	exportBackupHandler(rec, withUser(req, alice, "user"))
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	req = httptest.NewRequest("POST", "/v1/me/backup", strings.NewReader(rec.Body.String()))
+	req.Header.Set("X-Backup-Passphrase", "pass")
+	rec = httptest.NewRecorder()
+	importBackupHandler(rec, withUser(req, bob, "user"))
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	check(alice)
+	check(bob)
+
+	// drift from a hand edit is fixed by reconcile
+	db.Exec("DELETE FROM notes WHERE user_id = ?", bob)
+	if err := reconcileNoteCounts(); err != nil {
+		t.Fatal(err)
+	}
+	check(alice)
+	check(bob)
+}
+
+func TestSearchScopedToCaller(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestUser(t, "alice", "password1")
+	bob := createTestUser(t, "bob", "password1")
+	createUserNote(t, alice, "alice plan", "meeting at noon")
+	createUserNote(t, bob, "bob plan", "meeting at five")
+	createUserNote(t, bob, "bob other", "nothing here")
+
+	search := func(userId int, q string) []Note {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		getNotesHandler(rec, withUser(httptest.NewRequest("GET", "/v1/notes?q="+q, nil), userId, "user"))
+		if rec.Code != http.StatusOK {
+			t.Fatal(rec.Code, rec.Body.String())
+		}
+		var notes []Note
+		json.NewDecoder(rec.Body).Decode(&notes)
+		return notes
+	}
+	notes := search(alice, "meeting")
+	if len(notes) != 1 || notes[0].Title != "alice plan" {
+		t.Fatalf("alice search = %+v, want only alice's own note", notes)
+	}
+	notes = search(bob, "meeting")
+	if len(notes) != 1 || notes[0].Title != "bob plan" {
+		t.Fatalf("bob search = %+v, want only bob's own match", notes)
+	}
+	if notes := search(alice, "nothing"); len(notes) != 0 {
+		t.Fatalf("alice found bob's note: %+v", notes)
+	}
+}
+
+func TestNotesByTitle(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestUser(t, "alice", "password1")
+	bob := createTestUser(t, "bob", "password1")
+	createUserNote(t, alice, "groceries", "milk")
+	createUserNote(t, alice, "groceries", "eggs")
+	createUserNote(t, alice, "groceries list", "bread")
+	createUserNote(t, bob, "groceries", "bob's")
+
+	byTitle := func(title string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		getNotesByTitleHandler(rec, withUser(httptest.NewRequest("GET", "/v1/notes/by-title?title="+title, nil), alice, "user"))
+		return rec
+	}
+	rec := byTitle("groceries")
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	var notes []Note
+	json.NewDecoder(rec.Body).Decode(&notes)
+	if len(notes) != 2 {
+		t.Fatalf("got %d notes, want the 2 exact matches of alice: %+v", len(notes), notes)
+	}
+	for _, n := range notes {
+		if n.Title != "groceries" || n.UserID != alice {
+			t.Fatalf("unexpected note %+v", n)
+		}
+	}
+
+	rec = byTitle("missing")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("no match = %d %s, want 200 []", rec.Code, rec.Body.String())
+	}
+	if rec := byTitle(""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("empty title = %d, want 400", rec.Code)
+	}
+}
+
+func TestContentSchemaValidation(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestUser(t, "alice", "password1")
+	schema := `{"type":"object","required":["due"],"properties":{"due":{"type":"string"}}}`
+	rec := httptest.NewRecorder()
+	putContentSchemaHandler(rec, withUser(httptest.NewRequest("PUT", "/v1/me/content-schema", strings.NewReader(schema)), alice, "user"))
+	if rec.Code/100 != 2 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+
+	create := func(content string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"title":"task","content":%q}`, content)
+		rec := httptest.NewRecorder()
+		createNoteHandler(rec, withUser(httptest.NewRequest("POST", "/v1/notes", strings.NewReader(body)), alice, "user"))
+		return rec
+	}
+	if rec := create(`{"due":"friday"}`); rec.Code/100 != 2 {
+		t.Fatalf("conforming content = %d %s, want 2xx", rec.Code, rec.Body.String())
+	}
+	rec = create(`{"due":5}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("non-conforming content = %d, want 422", rec.Code)
+	}
+	var resp struct{ Errors []string }
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Errors) == 0 || !strings.Contains(strings.Join(resp.Errors, ";"), "/due") {
+		t.Fatalf("errors = %v, want one pointing at /due", resp.Errors)
+	}
+	if got := userNoteTitles(t, alice); got != "task" {
+		t.Fatalf("notes = %q, want only the conforming one", got)
+	}
+}
+
+func TestQueryParamLimit(t *testing.T) {
+	h := queryLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	params := make([]string, maxQueryParams+1)
+	for i := range params {
+		params[i] = fmt.Sprintf("p%d=1", i)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/notes?"+strings.Join(params, "&"), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("%d params = %d, want 400", len(params), rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/notes?limit=5&offset=10", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("normal query = %d, want 200", rec.Code)
+	}
+}
+
+func TestByteQuota(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestUser(t, "alice", "password1")
+	byteQuota = 12
+	t.Cleanup(func() { byteQuota = 0 })
+
+	create := func(content string) int {
+		body := fmt.Sprintf(`{"title":"n","content":%q}`, content)
+		rec := httptest.NewRecorder()
+		createNoteHandler(rec, withUser(httptest.NewRequest("POST", "/v1/notes", strings.NewReader(body)), alice, "user"))
+		return rec.Code
+	}
+	// "héllo" is 6 bytes, so two of them fill the quota exactly
+	for i := 0; i < 2; i++ {
+		if code := create("héllo"); code/100 != 2 {
+			t.Fatalf("create %d under quota = %d, want 2xx", i, code)
+		}
+	}
+	if code := create("x"); code != http.StatusForbidden {
+		t.Fatalf("create over quota = %d, want 403", code)
+	}
+
+	rec := httptest.NewRecorder()
+	statsHandler(rec, withUser(httptest.NewRequest("GET", "/v1/me/stats", nil), alice, "user"))
+	var stats map[string]int64
+	json.NewDecoder(rec.Body).Decode(&stats)
+	if stats["note_count"] != 2 || stats["bytes_used"] != 12 || stats["byte_quota"] != 12 {
+		t.Fatalf("stats = %v, want 2 notes, 12 of 12 bytes", stats)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	oldMode, oldQuota := signupMode, byteQuota
+	t.Cleanup(func() { signupMode, byteQuota = oldMode, oldQuota })
+	signupMode = "closed"
+	byteQuota = 1000
+
+	rec := httptest.NewRecorder()
+	capabilitiesHandler(rec, httptest.NewRequest("GET", "/v1/capabilities", nil))
+	var caps map[string]bool
+	if err := json.NewDecoder(rec.Body).Decode(&caps); err != nil {
+		t.Fatal(err)
+	}
+	if caps["signup"] {
+		t.Fatal("signup reported as on while signup is closed")
+	}
+	if !caps["storage_quota"] {
+		t.Fatal("storage_quota reported as off while a quota is set")
+	}
+}
@@ -1,251 +1,2303 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// global db connection
+// handlers hang off Server so each one gets its db from here instead of a global
+// (tests can build one around a ":memory:" db)
 // sql db is safe for concurrent use so we dont need mutex
-var db *sql.DB
+type Server struct {
+	db  *sql.DB
+	fts bool // notes_fts is usable, search uses MATCH instead of LIKE
+}
+
+func NewServer(db *sql.DB) *Server {
+	return &Server{db: db, fts: setupFTS(db)}
+}
 
 // initialize sql db and table
-func initDB() {
-	var err error
-	// create notes.db file
-	db, err = sql.Open("sqlite3", "./notes.db")
+func initDB() *sql.DB {
+	// sqlite file from DB_PATH, default notes.db (created if missing)
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		dbPath = "./notes.db"
+	}
+	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	// create notes table if not exists
-	createTable := `
+	configurePool(db)
+	if err := migrate(db); err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// ========== MIGRATIONS ============//
+// schema changes in order, each one runs once and is recorded in schema_migrations
+// to change the schema append a new version, never edit one that already shipped
+type migration struct {
+	version int
+	sql     string
+}
+
+var migrations = []migration{
+	// original table (IF NOT EXISTS so an existing notes.db just gets it recorded)
+	{1, `
 	CREATE TABLE IF NOT EXISTS notes (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		title TEXT NOT NULL,
 		content TEXT NOT NULL
-	);`
-	_, err = db.Exec(createTable)
+	);`},
+	// sqlite can't add a column with CURRENT_TIMESTAMP default, so insert sets it
+	// rows from before this stay NULL
+	// (notes.db from before migrations may already have it, initDB used to add it)
+	{2, `ALTER TABLE notes ADD COLUMN created_at DATETIME`},
+	// soft delete, NULL -> live note
+	{3, `ALTER TABLE notes ADD COLUMN deleted_at DATETIME`},
+	{4, `
+	CREATE TABLE tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL
+	);
+	CREATE TABLE note_tags (
+		note_id INTEGER NOT NULL REFERENCES notes(id),
+		tag_id INTEGER NOT NULL REFERENCES tags(id),
+		PRIMARY KEY (note_id, tag_id)
+	);
+	CREATE INDEX idx_note_tags_tag_id ON note_tags(tag_id);`},
+	// last change of the row or its tags, set by every write (no ON UPDATE in sqlite)
+	{5, `ALTER TABLE notes ADD COLUMN updated_at DATETIME`},
+	// notes from before version 5 count as changed when they were created
+	{6, `UPDATE notes SET updated_at = COALESCE(deleted_at, created_at, CURRENT_TIMESTAMP) WHERE updated_at IS NULL`},
+}
+
+// ========== FULL TEXT SEARCH ============//
+// fts5 is only compiled into go-sqlite3 with a build tag:
+//   go build -tags sqlite_fts5
+// so it lives outside the migrations, a binary without it must still start
+
+// external content table, the text stays in notes and the triggers keep the index in sync
+var ftsSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS notes_fts USING fts5(title, content, content='notes', content_rowid='id')`,
+	`CREATE TRIGGER IF NOT EXISTS notes_fts_ai AFTER INSERT ON notes BEGIN
+		INSERT INTO notes_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS notes_fts_ad AFTER DELETE ON notes BEGIN
+		INSERT INTO notes_fts(notes_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS notes_fts_au AFTER UPDATE OF title, content ON notes BEGIN
+		INSERT INTO notes_fts(notes_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+		INSERT INTO notes_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+	END`,
+}
+
+// creates notes_fts + triggers, false when this sqlite has no fts5
+func setupFTS(db *sql.DB) bool {
+	// can't just try the CREATE, IF NOT EXISTS succeeds on a db an fts5 build left behind
+	var hasFTS bool
+	db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&hasFTS)
+	if !hasFTS {
+		slog.Error("sqlite built without FTS5, /v1/notes/search falls back to LIKE (build with -tags sqlite_fts5)")
+		// triggers left by an fts5 build would make every write fail here
+		for _, t := range []string{"notes_fts_ai", "notes_fts_ad", "notes_fts_au"} {
+			db.Exec("DROP TRIGGER IF EXISTS " + t)
+		}
+		return false
+	}
+	if _, err := db.Exec(ftsSchema[0]); err != nil {
+		slog.Error("full text search disabled", "err", err)
+		return false
+	}
+	var triggers int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'notes_fts_%'").Scan(&triggers)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("full text search disabled", "err", err)
+		return false
+	}
+	if triggers == len(ftsSchema)-1 {
+		return true
+	}
+	// new index, or notes were written while the triggers were gone -> index everything again
+	for _, q := range ftsSchema[1:] {
+		if _, err := db.Exec(q); err != nil {
+			slog.Error("full text search disabled", "err", err)
+			return false
+		}
+	}
+	if _, err := db.Exec("INSERT INTO notes_fts(notes_fts) VALUES ('rebuild')"); err != nil {
+		slog.Error("full text search disabled", "err", err)
+		return false
+	}
+	return true
+}
+
+// user text -> fts5 query: every word quoted so punctuation can't be fts syntax,
+// all words must match
+func ftsQuery(q string) string {
+	words := strings.Fields(q)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// WHERE condition for ?q= on notes, fts when available else substring match
+func (s *Server) searchCond(q string) (string, []any) {
+	if s.fts {
+		return "id IN (SELECT rowid FROM notes_fts WHERE notes_fts MATCH ?)", []any{ftsQuery(q)}
+	}
+	return "(title LIKE ? OR content LIKE ?)", []any{"%" + q + "%", "%" + q + "%"}
+}
+
+// bring db schema up to date, safe to call on every start
+func migrate(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at DATETIME DEFAULT CURRENT_TIMESTAMP)")
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// runs one migration in a tx together with its schema_migrations row
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var done int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = ?", m.version).Scan(&done); err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+	// sqlite has no ADD COLUMN IF NOT EXISTS, so a leading ALTER is left out
+	// when pragma table_info already lists the column
+	stmts := m.sql
+	if c := addColumnRe.FindStringSubmatch(stmts); c != nil {
+		has, err := hasColumn(tx, c[1], c[2])
+		if err != nil {
+			return err
+		}
+		if has {
+			_, stmts, _ = strings.Cut(stmts, ";")
+		}
+	}
+	if strings.TrimSpace(stmts) != "" {
+		if _, err := tx.Exec(stmts); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", m.version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ALTER TABLE <table> ADD COLUMN <column> at the start of a migration
+var addColumnRe = regexp.MustCompile(`^\s*ALTER TABLE (\w+) ADD COLUMN (\w+)`)
+
+// true when table already has the column
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n)
+	return n > 0, err
+}
+
+// connection pool
+// sqlite allows only one writer at a time, with many open conns concurrent writes
+// fail with "database is locked" instead of waiting. one conn serializes all queries
+// in Go (no lock errors, but reads wait behind writes). DB_MAX_OPEN_CONNS raises it,
+// only worth it with WAL mode and mostly-read traffic, <= 0 means no limit.
+// idle conns are kept and never expire: closing the last conn
+// of a ":memory:" db would throw the whole db away
+var dbMaxOpenConns = 1
+
+func configurePool(db *sql.DB) {
+	dbMaxOpenConns = getEnvInt("DB_MAX_OPEN_CONNS", dbMaxOpenConns)
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(max(dbMaxOpenConns, 2))
+	db.SetConnMaxLifetime(0)
+}
+
+// ========== REQUEST TRANSACTION ============//
+// write requests (POST/PUT/PATCH/DELETE) run inside one transaction
+// so if a handler runs many statements they all commit or all roll back
+
+// ExecContext/QueryContext/... are same on *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+type ctxKey string
+
+const txKey ctxKey = "tx"
+
+// returns request transaction if there is one, otherwise plain db
+func (s *Server) dbFrom(r *http.Request) queryer {
+	if tx, ok := r.Context().Value(txKey).(*sql.Tx); ok {
+		return tx
 	}
+	return s.db
+}
+
+// max time all db work of one request may take
+var dbTimeout = 5 * time.Second
+
+// context for a handler's db calls: cancelled when client goes away or after dbTimeout
+func dbContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), dbTimeout)
+}
+
+// stuck query -> 503 json so client knows to retry, anything else -> 500 with msg
+func writeDBError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "database query timed out"})
+		return
+	}
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// commits/rolls back tx when the handler decides the status code
+// committing before status goes out means client never sees 2xx for data that wasn't saved
+type txResponseWriter struct {
+	http.ResponseWriter
+	tx     *sql.Tx
+	done   bool
+	failed bool // commit failed, 500 already sent so handler output is dropped
+}
+
+func (tw *txResponseWriter) WriteHeader(code int) {
+	if tw.done {
+		return
+	}
+	tw.done = true
+	if code >= 200 && code < 300 {
+		if err := tw.tx.Commit(); err != nil {
+			log.Println("commit failed:", err)
+			tw.failed = true
+			http.Error(tw.ResponseWriter, "Database error", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		tw.tx.Rollback()
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *txResponseWriter) Write(b []byte) (int, error) {
+	if !tw.done {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.failed {
+		return len(b), nil
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (s *Server) txMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		tx, err := s.db.BeginTx(r.Context(), nil)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		tw := &txResponseWriter{ResponseWriter: w, tx: tx}
+		defer func() {
+			// on panic nothing must be committed, then let panic continue
+			if p := recover(); p != nil {
+				if !tw.done {
+					tx.Rollback()
+				}
+				panic(p)
+			}
+			// handler wrote nothing -> implicit 200
+			if !tw.done {
+				tw.WriteHeader(http.StatusOK)
+			}
+		}()
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), txKey, tx)))
+	})
 }
 
 type Note struct {
-	ID      int    `json:"id"`
-	Title   string `json:"title"`
-	Content string `json:"content"`
+	ID               int     `json:"id"`
+	Title            string  `json:"title"`
+	Content          string  `json:"content"`
+	ContentTruncated bool    `json:"content_truncated,omitempty"` // only set on list with ?preview=N
+	DeletedAt        *string `json:"deleted_at,omitempty"`        // only set on list with ?include_deleted=true
+	// on update: missing -> tags stay as they are, [] -> remove all
+	// always sent back as a list, [] for an untagged note
+	Tags []string `json:"tags"`
+}
+
+// key used to sign pagination cursors
+// read from CURSOR_SECRET, otherwise random per process (old cursors stop working after restart)
+var cursorKey []byte
+
+func initCursorKey() {
+	if secret := os.Getenv("CURSOR_SECRET"); secret != "" {
+		cursorKey = []byte(secret)
+		return
+	}
+	cursorKey = make([]byte, 32)
+	if _, err := rand.Read(cursorKey); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// internal state of a cursor, never exposed to clients as is
+type cursorState struct {
+	LastID int `json:"last_id"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encode cursor as base64(json).base64(hmac) so clients can't craft or edit it
+func encodeCursor(c cursorState) string {
+	payload, _ := json.Marshal(c)
+	mac := hmac.New(sha256.New, cursorKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// decode and verify cursor, any tampering gives errInvalidCursor
+func decodeCursor(token string) (cursorState, error) {
+	var c cursorState
+	payloadPart, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return c, errInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadPart)
+	if err != nil || len(payload) == 0 {
+		return c, errInvalidCursor
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	mac := hmac.New(sha256.New, cursorKey)
+	mac.Write(payload)
+	// constant time compare so signature can't be guessed byte by byte
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return c, errInvalidCursor
+	}
+	if err := json.Unmarshal(payload, &c); err != nil || c.LastID < 0 {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
+
+// when true, an empty title on create is filled from content
+var autoTitle = false
+
+const autoTitleMaxLen = 60
+
+// build a title from first line/sentence of content
+// control chars are dropped, whitespace collapsed and result cut to autoTitleMaxLen runes
+func deriveTitle(content string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(content), "\n")
+	if i := strings.IndexAny(line, ".!?"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, line)
+	title := strings.Join(strings.Fields(line), " ")
+	if runes := []rune(title); len(runes) > autoTitleMaxLen {
+		title = strings.TrimSpace(string(runes[:autoTitleMaxLen])) + "..."
+	}
+	return title
 }
 
 // create a new note (for POST request)
 // In GO every handler must have these 2 args
 // responseWriter -> to write response back to client
 // request -> represents all incoming request from client
-func createNewNoteHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) createNewNoteHandler(w http.ResponseWriter, r *http.Request) {
 	var note Note
 	// decode json from request body into struct
-	err := json.NewDecoder(r.Body).Decode(&note)
+	err := decodeJSON(r, &note)
 	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
+	if autoTitle && strings.TrimSpace(note.Title) == "" {
+		note.Title = deriveTitle(note.Content)
+	}
+	if errs := validateNote(note); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
 	// insert into db
 	// using '?' placeholder helps prevent sql injection
 	// by using placeholders, query treats user input as data and not sql code
-	res, err := db.Exec("INSERT INTO notes (title, content) VALUES (?, ?)", note.Title, note.Content)
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := s.dbFrom(r).ExecContext(ctx, "INSERT INTO notes (title, content, created_at, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)", note.Title, note.Content)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err, err.Error())
 		return
 	}
 	id, _ := res.LastInsertId()
 	note.ID = int(id)
+	if note.Tags != nil {
+		note.Tags = normalizeTags(note.Tags)
+		if err := setNoteTags(ctx, s.dbFrom(r), note.ID, note.Tags); err != nil {
+			writeDBError(w, err, err.Error())
+			return
+		}
+	} else {
+		note.Tags = []string{}
+	}
 
 	//headers describe that response is in json , not plain text
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(note)
 }
 
-// get all notes (PAGINATION)
-func getNotesPaginationHandler(w http.ResponseWriter, r *http.Request) {
-	// read query params
-	// URL.Query()-> gives all query params as map
-	// ex-> /notes?page=2&limit=5 --> {"page": ["2"], "limit": ["5"] }
-	pageStr := r.URL.Query().Get("page")
-	limitStr := r.URL.Query().Get("limit")
-	page := 1   //default
-	limit := 10 //default
-	if pageStr != "" {
-		p, err := strconv.Atoi(pageStr)
-		if err == nil && p > 0 {
-			page = p
-		}
-	}
-	if limitStr != "" {
-		l, err := strconv.Atoi(limitStr)
-		if err == nil && l > 0 {
-			limit = l
+// create many notes at once (for imports)
+// POST runs in the request tx, so if any insert fails the 500 rolls back the whole batch
+func (s *Server) createNotesBulkHandler(w http.ResponseWriter, r *http.Request) {
+	var notes []Note
+	err := decodeJSON(r, &notes)
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
 		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
 	}
-	offset := (page - 1) * limit
-
-	rows, err := db.Query("SELECT id, title, content FROM notes LIMIT ? OFFESET ?", limit, offset)
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	// one prepared statement reused for every row
+	stmt, err := s.dbFrom(r).PrepareContext(ctx, "INSERT INTO notes (title, content, created_at, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)")
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		writeDBError(w, err, err.Error())
 		return
 	}
-	defer rows.Close()
-
-	var notes []Note
-	for rows.Next() {
-		var note Note
-		if err := rows.Scan(&note.ID, &note.Title, &note.Content); err != nil {
-			http.Error(w, "Error scanning row", http.StatusInternalServerError)
+	defer stmt.Close()
+	for i := range notes {
+		if autoTitle && strings.TrimSpace(notes[i].Title) == "" {
+			notes[i].Title = deriveTitle(notes[i].Content)
+		}
+		if errs := validateNote(notes[i]); len(errs) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{"index": i, "errors": errs})
+			return
+		}
+		res, err := stmt.ExecContext(ctx, notes[i].Title, notes[i].Content)
+		if err != nil {
+			writeDBError(w, err, err.Error())
+			return
+		}
+		id, _ := res.LastInsertId()
+		notes[i].ID = int(id)
+		notes[i].Tags = normalizeTags(notes[i].Tags)
+		if err := setNoteTags(ctx, s.dbFrom(r), notes[i].ID, notes[i].Tags); err != nil {
+			writeDBError(w, err, err.Error())
 			return
 		}
-		notes = append(notes, note)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(notes)
 }
 
-// get all notes (for GET request)
-func getNotesHandler(w http.ResponseWriter, r *http.Request) {
-	// SQL query to fetch all rows
-	rows, err := db.Query("SELECT id, title, content FROM notes")
+// ========== TAGS ============//
+
+// trimmed, without duplicates, sorted (so responses are stable)
+func normalizeTags(tags []string) []string {
+	out := []string{}
+	for _, t := range tags {
+		if t = strings.TrimSpace(t); t != "" && !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// tags of one note, sorted by name
+func noteTags(ctx context.Context, q queryer, noteID int) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT t.name FROM note_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.note_id = ? ORDER BY t.name", noteID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	//defer to ensure we release db resources once done
 	defer rows.Close()
-	var notesList []Note
+	tags := []string{}
 	for rows.Next() {
-		var n Note
-		err := rows.Scan(&n.ID, &n.Title, &n.Content)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
 		}
-		notesList = append(notesList, n)
+		tags = append(tags, name)
 	}
-
-	//send all notes as json response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(notesList)
+	return tags, rows.Err()
 }
 
-// get note by id
-func getNoteHandler(w http.ResponseWriter, r *http.Request) {
-	// mux.Vars returns map of path params (like /notes/{id})
-	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"]) // convert string id to int because our notes map uses 'int' keys
+// make the note's tags exactly `tags`: only the difference to the current set is written
+// callers pass the request tx so it commits or rolls back with the note itself
+func setNoteTags(ctx context.Context, q queryer, noteID int, tags []string) error {
+	current, err := noteTags(ctx, q, noteID)
 	if err != nil {
-		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		return err
+	}
+	changed := false
+	for _, t := range current {
+		if !slices.Contains(tags, t) {
+			_, err := q.ExecContext(ctx, "DELETE FROM note_tags WHERE note_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)", noteID, t)
+			if err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+	for _, t := range tags {
+		if slices.Contains(current, t) {
+			continue
+		}
+		if _, err := q.ExecContext(ctx, "INSERT OR IGNORE INTO tags (name) VALUES (?)", t); err != nil {
+			return err
+		}
+		_, err := q.ExecContext(ctx, "INSERT INTO note_tags (note_id, tag_id) SELECT ?, id FROM tags WHERE name = ?", noteID, t)
+		if err != nil {
+			return err
+		}
+		changed = true
+	}
+	// a tag change is a change of the note too (Last-Modified)
+	if changed {
+		_, err = q.ExecContext(ctx, "UPDATE notes SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", noteID)
+	}
+	return err
+}
+
+// PUT /tags/{old}/rename {"name": "new"}: every note with the old tag gets the new one instead
+// a note that already has both keeps a single link, the old tag row is removed then.
+// runs in the request tx, responds with the number of notes that had the old tag
+func (s *Server) renameTagHandler(w http.ResponseWriter, r *http.Request) {
+	oldName := strings.TrimSpace(mux.Vars(r)["old"])
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
-	var note Note
-	err = db.QueryRow("SELECT id, title, content FROM notes WHERE id = ?", id).Scan(&note.ID, &note.Title, &note.Content)
+	newName := strings.TrimSpace(req.Name)
+	if newName == "" {
+		writeValidationErrors(w, map[string]string{"name": "name is required"})
+		return
+	} else if utf8.RuneCountInString(newName) > maxTagLen {
+		writeValidationErrors(w, map[string]string{"name": fmt.Sprintf("name must be at most %d characters", maxTagLen)})
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	q := s.dbFrom(r)
+	var oldID int
+	err := q.QueryRowContext(ctx, "SELECT id FROM tags WHERE name = ?", oldName).Scan(&oldID)
 	if err == sql.ErrNoRows {
-		http.Error(w, "Note not found", http.StatusNotFound)
+		http.Error(w, "Tag not found", http.StatusNotFound)
 		return
 	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err, err.Error())
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(note)
-}
-
-// delete note by id
-func deleteNoteHandler(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
+	// tag changes count as changes of the note (Last-Modified)
+	res, err := q.ExecContext(ctx, "UPDATE notes SET updated_at = CURRENT_TIMESTAMP WHERE id IN (SELECT note_id FROM note_tags WHERE tag_id = ?)", oldID)
 	if err != nil {
-		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		writeDBError(w, err, err.Error())
 		return
 	}
-
-	_, err = db.Exec("DELETE FROM notes WHERE id=?", id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	affected, _ := res.RowsAffected()
+	if newName != oldName {
+		var newID int
+		err = q.QueryRowContext(ctx, "SELECT id FROM tags WHERE name = ?", newName).Scan(&newID)
+		switch {
+		case err == sql.ErrNoRows:
+			// plain rename, the links stay as they are
+			_, err = q.ExecContext(ctx, "UPDATE tags SET name = ? WHERE id = ?", newName, oldID)
+		case err == nil:
+			// merge: move the links over, OR IGNORE drops the ones the note has already
+			_, err = q.ExecContext(ctx, "INSERT OR IGNORE INTO note_tags (note_id, tag_id) SELECT note_id, ? FROM note_tags WHERE tag_id = ?", newID, oldID)
+			if err == nil {
+				_, err = q.ExecContext(ctx, "DELETE FROM note_tags WHERE tag_id = ?", oldID)
+			}
+			if err == nil {
+				_, err = q.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", oldID)
+			}
+		}
+		if err != nil {
+			writeDBError(w, err, err.Error())
+			return
+		}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"tag": newName, "notes_affected": affected})
+}
 
-	//return empty resposne with status 204 (no content)
-	w.WriteHeader(http.StatusNoContent)
+// ids per IN (...) query, stays below sqlite's limit of bound variables
+const tagsBatchSize = 500
+
+// note id -> tags for the given notes only ([] for untagged ones), one query per batch of ids
+func notesTags(ctx context.Context, q queryer, ids []int) (map[int][]string, error) {
+	byNote := make(map[int][]string, len(ids))
+	for _, id := range ids {
+		byNote[id] = []string{}
+	}
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), tagsBatchSize)]
+		ids = ids[len(batch):]
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+		rows, err := q.QueryContext(ctx, "SELECT nt.note_id, t.name FROM note_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.note_id IN ("+placeholders+") ORDER BY t.name", args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			var name string
+			if err := rows.Scan(&id, &name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			byNote[id] = append(byNote[id], name)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return byNote, nil
 }
 
-// update note by id
-func updateNoteHandler(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
-	if err != nil {
-		http.Error(w, "Invalid note id", http.StatusBadRequest)
-		return
+// fill in Tags of every note in the slice
+func loadTags(ctx context.Context, q queryer, notes []Note) error {
+	ids := make([]int, len(notes))
+	for i, n := range notes {
+		ids[i] = n.ID
 	}
-	var updatedData Note
-	//Reads json from request body and fills updatedData
-	err = json.NewDecoder(r.Body).Decode(&updatedData)
+	byNote, err := notesTags(ctx, q, ids)
 	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+		return err
 	}
-	_, err = db.Exec("UPDATE notes SET title=?, content=? WHERE id=?", updatedData.Title, updatedData.Content, updatedData.ID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	for i := range notes {
+		notes[i].Tags = byNote[notes[i].ID]
 	}
-	updatedData.ID = id
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updatedData)
+	return nil
 }
 
-func searchNotesHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		http.Error(w, "Missing search query", http.StatusBadRequest)
-		return
+// limits for note fields (in runes)
+const maxTitleLen = 200
+const maxContentLen = 10000
+const maxTagLen = 50
+
+// shared note validation, returns field name -> problem (empty map means valid)
+func validateNote(note Note) map[string]string {
+	errs := map[string]string{}
+	title := strings.TrimSpace(note.Title)
+	content := strings.TrimSpace(note.Content)
+	if title == "" {
+		errs["title"] = "title is required"
+	} else if utf8.RuneCountInString(title) > maxTitleLen {
+		errs["title"] = fmt.Sprintf("title must be at most %d characters", maxTitleLen)
 	}
-	// "%"+query+"%"-> for partial matching
-	rows, err := db.Query(
-		"SELECT id, title, content FROM notes WHERE title LIKE ? OR content LIKE ?",
-		"%"+query+"%", "%"+query+"%",
-	)
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+	if content == "" {
+		errs["content"] = "content is required"
+	} else if utf8.RuneCountInString(content) > maxContentLen {
+		errs["content"] = fmt.Sprintf("content must be at most %d characters", maxContentLen)
 	}
-	var notes []Note
-	for rows.Next() {
-		var note Note
-		if err := rows.Scan(&note.ID, &note.Title, &note.Content); err != nil {
-			http.Error(w, "Error scanning row", http.StatusInternalServerError)
-			return
+	for _, t := range note.Tags {
+		if strings.TrimSpace(t) == "" {
+			errs["tags"] = "tags can't be empty"
+		} else if utf8.RuneCountInString(strings.TrimSpace(t)) > maxTagLen {
+			errs["tags"] = fmt.Sprintf("tags must be at most %d characters", maxTagLen)
 		}
-		notes = append(notes, note)
+	}
+	return errs
+}
+
+// 400 with field name -> problem, used by create and update
+func writeValidationErrors(w http.ResponseWriter, errs map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{"errors": errs})
+}
+
+// check a note without saving it (for editors to pre-flight)
+func (s *Server) validateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	var note Note
+	if err := decodeJSON(r, &note); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if autoTitle && strings.TrimSpace(note.Title) == "" {
+		note.Title = deriveTitle(note.Content)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if errs := validateNote(note); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{"valid": false, "errors": errs})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"valid": true})
+}
+
+// server side page size limits
+var pageSize = 10
+var maxPageSize = 100
+
+// default limit when ?limit is missing
+// client can choose its own with X-Default-Page-Size (1..maxPageSize), bad values are ignored
+func defaultPageSize(r *http.Request) int {
+	if v := r.Header.Get("X-Default-Page-Size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n > 0 && n <= maxPageSize {
+			return n
+		}
+	}
+	return pageSize
+}
+
+// set list headers (X-Total-Count, ETag) from one aggregate query
+// so HEAD can answer without loading/serializing every note
+// the etag is weak: built from count, max id, total text length, deleted count and the tag links
+// counts the whole filtered list (opts.where), not the requested page
+// Last-Modified is the newest updated_at of the whole table: a note that just left the
+// filtered list (deleted, tag removed) has changed the list as well
+func (s *Server) setListHeaders(ctx context.Context, w http.ResponseWriter, opts listOptions) error {
+	var count, maxID, size, deleted, tagLinks, tagSum int64
+	var lastModified sql.NullString
+	query := "SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(SUM(LENGTH(title) + LENGTH(content)), 0), COUNT(deleted_at), " +
+		"(SELECT MAX(updated_at) FROM notes), " +
+		"(SELECT COUNT(*) FROM note_tags WHERE note_id IN (SELECT id FROM notes " + opts.where + ")), " +
+		// which tag sits on which note, so moving a tag changes the etag too
+		"(SELECT COALESCE(SUM(note_id * 1000003 + tag_id), 0) FROM note_tags WHERE note_id IN (SELECT id FROM notes " + opts.where + ")) " +
+		"FROM notes " + opts.where
+	args := append(append(slices.Clone(opts.args), opts.args...), opts.args...)
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&count, &maxID, &size, &deleted, &lastModified, &tagLinks, &tagSum)
+	if err != nil {
+		return err
+	}
+	// CURRENT_TIMESTAMP is UTC "YYYY-MM-DD HH:MM:SS", go-sqlite3 may hand it back as RFC 3339
+	if lastModified.Valid {
+		for _, layout := range []string{time.DateTime, time.RFC3339} {
+			if t, err := time.Parse(layout, lastModified.String); err == nil {
+				w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+				break
+			}
+		}
+	}
+	w.Header().Set("X-Total-Count", strconv.FormatInt(count, 10))
+	w.Header().Set("ETag", fmt.Sprintf(`W/"%d-%d-%d-%d-%d-%d"`, count, maxID, size, deleted, tagLinks, tagSum))
+	return nil
+}
+
+// number of notes, for pagers
+// filtered like the list (?tag=, ?include_deleted), ?q= counts with the same match as /notes/search
+func (s *Server) countNotesHandler(w http.ResponseWriter, r *http.Request) {
+	var opts listOptions
+	listFilter(r, &opts)
+	where, args := opts.where, opts.args
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		cond, condArgs := s.searchCond(q)
+		if where == "" {
+			where = "WHERE " + cond
+		} else {
+			where += " AND " + cond
+		}
+		args = append(args, condArgs...)
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM notes "+where, args...).Scan(&count)
+	if err != nil {
+		writeDBError(w, err, "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"count": count})
+}
+
+// HEAD /notes -> same headers as GET but no body
+func (s *Server) headNotesHandler(w http.ResponseWriter, r *http.Request) {
+	var opts listOptions
+	listFilter(r, &opts)
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	if err := s.setListHeaders(ctx, w, opts); err != nil {
+		writeDBError(w, err, "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
+// columns a client may ask for with ?fields=
+// map value is used as sql column name so raw input is never put into query
+var selectableFields = map[string]string{
+	"id":      "id",
+	"title":   "title",
+	"content": "content",
+}
+
+// parse ?fields=id,title into column list, id is always included
+func parseFields(raw string) ([]string, error) {
+	fields := []string{"id"}
+	for _, f := range strings.Split(raw, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" || f == "id" {
+			continue
+		}
+		col, ok := selectableFields[f]
+		if !ok {
+			return nil, fmt.Errorf("unknown field: %s", f)
+		}
+		if !slices.Contains(fields, col) {
+			fields = append(fields, col)
+		}
+	}
+	return fields, nil
+}
+
+// options of list request, parsed and validated from query params
+type listOptions struct {
+	fields  []string // nil means all fields
+	orderBy string   // safe ORDER BY clause from listOrderBy
+	preview int      // >0 -> cut content to this many runes
+	where   string   // WHERE clause built from fixed strings: soft deleted (?include_deleted) and ?tag=
+	args    []any    // values for the placeholders in where
+	limit   int      // page size, 0 -> no paging, whole list
+	offset  int      // from ?page
+	afterID int      // from ?cursor, only notes with a bigger id
+}
+
+// ?include_deleted and ?tag= -> opts.where/args, shared by GET and HEAD
+func listFilter(r *http.Request, opts *listOptions) {
+	var conds []string
+	// meant for admins, this service has no auth so anyone who can reach it can ask
+	if r.URL.Query().Get("include_deleted") != "true" {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if tag := strings.TrimSpace(r.URL.Query().Get("tag")); tag != "" {
+		conds = append(conds, "id IN (SELECT nt.note_id FROM note_tags nt JOIN tags t ON t.id = nt.tag_id WHERE t.name = ?)")
+		opts.args = append(opts.args, tag)
+	}
+	if len(conds) > 0 {
+		opts.where = "WHERE " + strings.Join(conds, " AND ")
+	}
+}
+
+// page of the list as selected by opts, the cursor only narrows the page
+// (where/args alone describe the whole filtered list, which is what the headers count)
+func (o listOptions) query(cols string) (string, []any) {
+	where := o.where
+	args := slices.Clone(o.args)
+	if o.afterID > 0 {
+		if where == "" {
+			where = "WHERE id > ?"
+		} else {
+			where += " AND id > ?"
+		}
+		args = append(args, o.afterID)
+	}
+	q := "SELECT " + cols + " FROM notes " + where + " ORDER BY " + o.orderBy
+	if o.limit > 0 {
+		q += " LIMIT ? OFFSET ?"
+		args = append(args, o.limit, o.offset)
+	}
+	return q, args
+}
+
+// ?page, ?limit and ?cursor -> limit/offset/afterID in opts
+// without any of them (and without X-Default-Page-Size) the list isn't paged, like before paging existed
+func parsePaging(r *http.Request, opts *listOptions) error {
+	q := r.URL.Query()
+	pageStr, limitStr, cursorStr := q.Get("page"), q.Get("limit"), q.Get("cursor")
+	if pageStr == "" && limitStr == "" && cursorStr == "" && r.Header.Get("X-Default-Page-Size") == "" {
+		return nil
+	}
+	opts.limit = defaultPageSize(r)
+	if limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 {
+			return errors.New("limit must be a positive number")
+		}
+		opts.limit = min(l, maxPageSize)
+	}
+	// ?cursor= takes priority over page, it continues right after the last note of previous page
+	if cursorStr != "" {
+		// cursor holds the last id, so it only means something when sorted by id
+		if opts.orderBy != "id ASC" {
+			return errors.New("cursor only works with the default sort")
+		}
+		c, err := decodeCursor(cursorStr)
+		if err != nil {
+			return err
+		}
+		opts.afterID = c.LastID
+		return nil
+	}
+	if pageStr != "" {
+		p, err := strconv.Atoi(pageStr)
+		if err != nil || p <= 0 {
+			return errors.New("page must be a positive number")
+		}
+		opts.offset = (p - 1) * opts.limit
+	}
+	return nil
+}
+
+// full page means there may be more, give client an opaque token for next page
+func setNextCursor(w http.ResponseWriter, opts listOptions, n int, lastID int) {
+	if opts.limit > 0 && n == opts.limit && opts.orderBy == "id ASC" {
+		w.Header().Set("X-Next-Cursor", encodeCursor(cursorState{LastID: lastID}))
+	}
+}
+
+// cut s to n runes (on rune boundary so multi-byte chars are never split)
+// second return is true if something was cut
+func truncateRunes(s string, n int) (string, bool) {
+	if utf8.RuneCountInString(s) <= n {
+		return s, false
+	}
+	return string([]rune(s)[:n]) + "…", true
+}
+
+// list notes with only the requested fields
+func (s *Server) getNotesFieldsHandler(ctx context.Context, w http.ResponseWriter, opts listOptions) {
+	fields := opts.fields
+	query, args := opts.query(strings.Join(fields, ", "))
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	defer rows.Close()
+	notesList := []map[string]any{}
+	lastID := 0
+	for rows.Next() {
+		var n Note
+		// point each selected column at matching field of the note
+		dest := make([]any, len(fields))
+		for i, f := range fields {
+			switch f {
+			case "id":
+				dest[i] = &n.ID
+			case "title":
+				dest[i] = &n.Title
+			case "content":
+				dest[i] = &n.Content
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		item := map[string]any{}
+		for _, f := range fields {
+			switch f {
+			case "id":
+				item["id"] = n.ID
+			case "title":
+				item["title"] = n.Title
+			case "content":
+				item["content"] = n.Content
+				if opts.preview > 0 {
+					var cut bool
+					item["content"], cut = truncateRunes(n.Content, opts.preview)
+					item["content_truncated"] = cut
+				}
+			}
+		}
+		notesList = append(notesList, item)
+		lastID = n.ID
+	}
+	setNextCursor(w, opts, len(notesList), lastID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notesList)
+}
+
+// collation used when sorting by title
+// NOCASE (default) -> "apple" before "Banana", but it only folds ASCII letters, so "é"/"É" still differ
+// BINARY -> byte order, fastest and can use a plain index, but every uppercase letter sorts before lowercase
+// RTRIM -> like BINARY but ignores trailing spaces
+// none of them are locale aware, that would need a custom collation registered on the driver
+var titleCollation = "NOCASE"
+
+var allowedCollations = []string{"NOCASE", "BINARY", "RTRIM"}
+
+// ORDER BY clause for ?sort= and ?order= (only fixed strings, never raw input)
+// id is added as tie breaker so equal titles keep a stable order
+func listOrderBy(sort, order string) (string, error) {
+	var dir string
+	switch order {
+	case "", "asc":
+		dir = " ASC"
+	case "desc":
+		dir = " DESC"
+	default:
+		return "", fmt.Errorf("invalid order: %s", order)
+	}
+	// only these column names ever end up in the sql
+	switch sort {
+	case "", "id":
+		return "id" + dir, nil
+	case "title":
+		return "title COLLATE " + titleCollation + dir + ", id" + dir, nil
+	case "created_at":
+		return "created_at" + dir + ", id" + dir, nil
+	default:
+		return "", fmt.Errorf("invalid sort: %s", sort)
+	}
+}
+
+// get all notes (for GET request), paged when ?page/?limit/?cursor is given
+func (s *Server) getNotesHandler(w http.ResponseWriter, r *http.Request) {
+	var opts listOptions
+	var err error
+	opts.orderBy, err = listOrderBy(r.URL.Query().Get("sort"), r.URL.Query().Get("order"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if raw := r.URL.Query().Get("fields"); raw != "" {
+		opts.fields, err = parseFields(raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := r.URL.Query().Get("preview"); raw != "" {
+		opts.preview, err = strconv.Atoi(raw)
+		if err != nil || opts.preview <= 0 {
+			http.Error(w, "preview must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	listFilter(r, &opts)
+	if err := parsePaging(r, &opts); errors.Is(err, errInvalidCursor) {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	if err := s.setListHeaders(ctx, w, opts); err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	if opts.fields != nil {
+		s.getNotesFieldsHandler(ctx, w, opts)
+		return
+	}
+	// SQL query to fetch all rows
+	query, args := opts.query("id, title, content, deleted_at")
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	//defer to ensure we release db resources once done
+	defer rows.Close()
+	var notesList []Note
+	for rows.Next() {
+		var n Note
+		err := rows.Scan(&n.ID, &n.Title, &n.Content, &n.DeletedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if opts.preview > 0 {
+			n.Content, n.ContentTruncated = truncateRunes(n.Content, opts.preview)
+		}
+		notesList = append(notesList, n)
+	}
+	if err := rows.Err(); err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	// tags only for the notes of this page, after rows is done with the connection
+	rows.Close()
+	if err := loadTags(ctx, s.db, notesList); err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	if len(notesList) > 0 {
+		setNextCursor(w, opts, len(notesList), notesList[len(notesList)-1].ID)
+	}
+
+	//send all notes as json response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notesList)
+}
+
+// strong etag of a single note, changes whenever title, content or tags change
+// n.Tags must be the stored (sorted) set
+func noteETag(n Note) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s\x00%s", n.ID, n.Title, n.Content, strings.Join(n.Tags, "\x00"))))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// If-Match can be "*" or a comma separated list of etags
+func etagMatches(ifMatch, etag string) bool {
+	for _, t := range strings.Split(ifMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// get note by id
+func (s *Server) getNoteHandler(w http.ResponseWriter, r *http.Request) {
+	// mux.Vars returns map of path params (like /notes/{id})
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"]) // convert string id to int because our notes map uses 'int' keys
+	if err != nil {
+		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var note Note
+	err = s.db.QueryRowContext(ctx, "SELECT id, title, content FROM notes WHERE id = ? AND deleted_at IS NULL", id).Scan(&note.ID, &note.Title, &note.Content)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	note.Tags, err = noteTags(ctx, s.db, id)
+	if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	w.Header().Set("ETag", noteETag(note))
+	// ?raw=true -> send only content as plain text
+	// ServeContent handles Range header (206 + Content-Range, or 416 for bad range)
+	if r.URL.Query().Get("raw") == "true" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(note.Content))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// delete note by id
+func (s *Server) deleteNoteHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	// soft delete, row stays so it can be restored
+	result, err := s.dbFrom(r).ExecContext(ctx, "UPDATE notes SET deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id=? AND deleted_at IS NULL", id)
+	if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	// already deleted counts as missing, same as GET
+	if n, err := result.RowsAffected(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if n == 0 {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	}
+
+	//return empty resposne with status 204 (no content)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// outcome of one record in POST /notes/import
+type importError struct {
+	Index  int               `json:"index"`
+	Errors map[string]string `json:"errors"`
+}
+
+type importResult struct {
+	Inserted int           `json:"inserted"`
+	Updated  int           `json:"updated"`
+	Failed   int           `json:"failed"`
+	Errors   []importError `json:"errors,omitempty"`
+}
+
+// import a json array of notes: id of an existing note -> update it, anything else -> new note
+// everything runs in the request tx. invalid records are skipped and reported,
+// with ?strict=true the first invalid one fails the whole import (400, nothing saved)
+func (s *Server) importNotesHandler(w http.ResponseWriter, r *http.Request) {
+	var notes []Note
+	if err := decodeJSON(r, &notes); err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	strict := r.URL.Query().Get("strict") == "true"
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	q := s.dbFrom(r)
+	res := importResult{}
+	for i, note := range notes {
+		if autoTitle && strings.TrimSpace(note.Title) == "" {
+			note.Title = deriveTitle(note.Content)
+		}
+		if errs := validateNote(note); len(errs) > 0 {
+			if strict {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(importError{Index: i, Errors: errs})
+				return
+			}
+			res.Failed++
+			res.Errors = append(res.Errors, importError{Index: i, Errors: errs})
+			continue
+		}
+		// same as update: no tags in the record -> an updated note keeps its tags
+		if note.Tags != nil {
+			note.Tags = normalizeTags(note.Tags)
+		}
+		if note.ID > 0 {
+			result, err := q.ExecContext(ctx, "UPDATE notes SET title=?, content=?, updated_at=CURRENT_TIMESTAMP WHERE id=? AND deleted_at IS NULL", note.Title, note.Content, note.ID)
+			if err != nil {
+				writeDBError(w, err, err.Error())
+				return
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				if note.Tags != nil {
+					if err := setNoteTags(ctx, q, note.ID, note.Tags); err != nil {
+						writeDBError(w, err, err.Error())
+						return
+					}
+				}
+				res.Updated++
+				continue
+			}
+		}
+		result, err := q.ExecContext(ctx, "INSERT INTO notes (title, content, created_at, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)", note.Title, note.Content)
+		if err != nil {
+			writeDBError(w, err, err.Error())
+			return
+		}
+		if note.Tags != nil {
+			id, _ := result.LastInsertId()
+			if err := setNoteTags(ctx, q, int(id), note.Tags); err != nil {
+				writeDBError(w, err, err.Error())
+				return
+			}
+		}
+		res.Inserted++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// all live notes as a csv download
+// rows are written out while they are read, so memory stays flat for any number of notes
+// uses the request deadline (requestTimeout) instead of dbTimeout, a big export can take a while
+func (s *Server) exportNotesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.QueryContext(r.Context(), "SELECT id, title, content, COALESCE(created_at, '') FROM notes WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	defer rows.Close()
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="notes.csv"`)
+	// csv writer quotes fields with commas, quotes or newlines by itself
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "title", "content", "created_at"})
+	for rows.Next() {
+		var n Note
+		var createdAt string
+		if err := rows.Scan(&n.ID, &n.Title, &n.Content, &createdAt); err != nil {
+			// header is already sent, all we can do is stop and log
+			log.Printf("csv export: %v", err)
+			break
+		}
+		if err := cw.Write([]string{strconv.Itoa(n.ID), n.Title, n.Content, createdAt}); err != nil {
+			log.Printf("csv export: %v", err)
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("csv export: %v", err)
+	}
+	cw.Flush()
+}
+
+// undo a soft delete
+func (s *Server) restoreNoteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	result, err := s.dbFrom(r).ExecContext(ctx, "UPDATE notes SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id=? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	// missing note and live note are both "nothing to restore"
+	if n, err := result.RowsAffected(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if n == 0 {
+		http.Error(w, "No deleted note with this id", http.StatusNotFound)
+		return
+	}
+	var note Note
+	err = s.dbFrom(r).QueryRowContext(ctx, "SELECT id, title, content FROM notes WHERE id = ?", id).Scan(&note.ID, &note.Title, &note.Content)
+	if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	if note.Tags, err = noteTags(ctx, s.dbFrom(r), id); err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// update note by id
+func (s *Server) updateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		return
+	}
+	var updatedData Note
+	//Reads json from request body and fills updatedData
+	err = decodeJSON(r, &updatedData)
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if errs := validateNote(updatedData); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	// If-Match -> only update when client has seen the current version (else 412)
+	// read inside request tx so nobody can change it between check and update
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		var current Note
+		err = s.dbFrom(r).QueryRowContext(ctx, "SELECT id, title, content FROM notes WHERE id = ? AND deleted_at IS NULL", id).Scan(&current.ID, &current.Title, &current.Content)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Note not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeDBError(w, err, err.Error())
+			return
+		}
+		if current.Tags, err = noteTags(ctx, s.dbFrom(r), id); err != nil {
+			writeDBError(w, err, err.Error())
+			return
+		}
+		if !etagMatches(ifMatch, noteETag(current)) {
+			http.Error(w, "Note was modified", http.StatusPreconditionFailed)
+			return
+		}
+	}
+	// path id decides which row, id in body is ignored
+	result, err := s.dbFrom(r).ExecContext(ctx, "UPDATE notes SET title=?, content=?, updated_at=CURRENT_TIMESTAMP WHERE id=? AND deleted_at IS NULL", updatedData.Title, updatedData.Content, id)
+	if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if n == 0 {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	}
+	updatedData.ID = id
+	if updatedData.Tags != nil {
+		updatedData.Tags = normalizeTags(updatedData.Tags)
+		err = setNoteTags(ctx, s.dbFrom(r), id, updatedData.Tags)
+	} else {
+		updatedData.Tags, err = noteTags(ctx, s.dbFrom(r), id)
+	}
+	if err != nil {
+		writeDBError(w, err, err.Error())
+		return
+	}
+	w.Header().Set("ETag", noteETag(updatedData))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updatedData)
+}
+
+// hard upper bound of rows a single search can return, no matter what
+// a cut off result is still a plain array, X-Truncated: true tells the client there were more matches
+var maxSearchResults = 500
+
+func (s *Server) searchNotesHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Missing search query", http.StatusBadRequest)
+		return
+	}
+	// fetch one extra row, if it shows up we know result was cut off
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var rows *sql.Rows
+	var err error
+	if s.fts {
+		// bm25 is lower for better matches, so ascending = most relevant first
+		rows, err = s.db.QueryContext(ctx,
+			"SELECT n.id, n.title, n.content FROM notes_fts JOIN notes n ON n.id = notes_fts.rowid WHERE notes_fts MATCH ? AND n.deleted_at IS NULL ORDER BY bm25(notes_fts) LIMIT ?",
+			ftsQuery(query), maxSearchResults+1,
+		)
+	} else {
+		// "%"+query+"%"-> for partial matching
+		cond, args := s.searchCond(query)
+		rows, err = s.db.QueryContext(ctx,
+			"SELECT id, title, content FROM notes WHERE "+cond+" AND deleted_at IS NULL ORDER BY id LIMIT ?",
+			append(args, maxSearchResults+1)...,
+		)
+	}
+	if err != nil {
+		writeDBError(w, err, "Database error")
+		return
+	}
+	defer rows.Close()
+	notes := []Note{}
+	for rows.Next() {
+		var note Note
+		if err := rows.Scan(&note.ID, &note.Title, &note.Content); err != nil {
+			http.Error(w, "Error scanning row", http.StatusInternalServerError)
+			return
+		}
+		notes = append(notes, note)
+	}
+	rows.Close()
+	if len(notes) > maxSearchResults {
+		notes = notes[:maxSearchResults]
+		w.Header().Set("X-Truncated", "true")
+	}
+	if err := loadTags(ctx, s.db, notes); err != nil {
+		writeDBError(w, err, "Database error")
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(notes)
 }
 
+// read int config from env, fallback to default when unset or invalid
+func getEnvInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using default %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// read bool config from env ("1", "true", ...), fallback to default when unset or invalid
+func getEnvBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using default %t", name, v, def)
+		return def
+	}
+	return b
+}
+
+// read duration config from env (like "30s"), fallback to default when unset or invalid
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("invalid %s=%q, using default %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// hard ceiling for a whole request
+var requestTimeout = 30 * time.Second
+
+// paths whose handler writes straight to the client instead of through timeoutWriter
+var streamedRoutes = map[string]bool{
+	"/v1/notes/export": true,
+}
+
+// buffers handler output so nothing reaches client after a timeout
+// (same idea as http.TimeoutHandler but the 504 body is json)
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = code
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+// cancel request context after requestTimeout and answer 504 json
+// handlers/db calls using r.Context() stop their work when it fires
+func timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+		// streamed responses can't be buffered, they only get the context deadline
+		// (a timeout there just cuts the response off)
+		if streamedRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+		select {
+		case p := <-panicked:
+			// re-panic in serving goroutine so it is handled like any other panic
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for k, v := range tw.header {
+				w.Header()[k] = v
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(map[string]string{"error": "request timed out"})
+		}
+	})
+}
+
+// limits for query string, checked before any handler calls r.URL.Query()
+var maxQueryParams = 50
+var maxRepeatedParam = 10
+
+// browser origins allowed to call this api, from ALLOWED_ORIGINS (comma separated)
+// empty -> no CORS headers, only same-origin pages can use it
+var allowedOrigins = map[string]bool{}
+
+func parseAllowedOrigins(v string) {
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			allowedOrigins[o] = true
+		}
+	}
+}
+
+// what cross-origin requests may send, and which response headers scripts may read
+const corsAllowMethods = "GET, HEAD, POST, PUT, DELETE"
+const corsAllowHeaders = "Content-Type, If-Match, X-Default-Page-Size, X-Request-ID"
+const corsExposeHeaders = "Content-Disposition, ETag, X-Total-Count, X-Next-Cursor, X-Truncated, Retry-After, Deprecation, Sunset, Warning, X-Request-ID"
+
+// echoes the origin back only when allowlisted (never "*", so cookies/auth headers work)
+// preflight OPTIONS is answered here with 204, router has no OPTIONS routes
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !allowedOrigins[origin] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		h.Add("Vary", "Origin")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ========== REQUEST ID ============//
+// every request gets an id: the caller's X-Request-ID if it looks sane, else a new uuid
+// it is echoed back in the response and logged, so one request can be followed across services
+
+const requestIDKey ctxKey = "requestId"
+
+// longer or odd looking ids are replaced, they end up in log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// random (version 4) uuid
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// "" when the request didn't go through requestIDMiddleware
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// one line per request, text by default, LOG_FORMAT=json for log collectors
+var accessLog = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+func setLogFormat(format string) {
+	switch strings.ToLower(format) {
+	case "", "text":
+	case "json":
+		accessLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	default:
+		log.Printf("unknown LOG_FORMAT=%q, using text", format)
+	}
+}
+
+// remembers status and bytes written so they can be logged afterwards
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.size += n
+	return n, err
+}
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		// handler that writes nothing is an implicit 200
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		accessLog.Info("request",
+			"request_id", requestIDFromContext(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sr.status,
+			"size", sr.size,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+// ========== GZIP ============//
+// for list endpoints, wrap the handler: gzipMiddleware(http.HandlerFunc(h))
+
+// smaller bodies are sent as is, gzip overhead isn't worth it
+const gzipMinSize = 1024
+
+// true when Accept-Encoding lists gzip with a non-zero q
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(v, 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// holds back the first gzipMinSize bytes to decide if compressing is worth it
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	buf     []byte
+	status  int
+	started bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
+	}
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.started {
+		g.buf = append(g.buf, b...)
+		if len(g.buf) < gzipMinSize {
+			return len(b), nil
+		}
+		if err := g.start(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// sends the header and whatever is buffered, compressed or not
+func (g *gzipWriter) start() error {
+	g.started = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	h := g.Header()
+	ct := h.Get("Content-Type")
+	// already encoded by the handler, or a format that is compressed anyway
+	compressed := h.Get("Content-Encoding") != "" || strings.HasPrefix(ct, "image/") ||
+		ct == "application/zip" || ct == "application/gzip"
+	if len(g.buf) >= gzipMinSize && !compressed && g.status != http.StatusNoContent && g.status != http.StatusNotModified {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(g.buf)
+	} else {
+		_, err = g.ResponseWriter.Write(g.buf)
+	}
+	g.buf = nil
+	return err
+}
+
+func (g *gzipWriter) Flush() {
+	if !g.started {
+		g.start()
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writes out a small body that never reached gzipMinSize, and the gzip footer
+func (g *gzipWriter) close() {
+	if !g.started {
+		g.start()
+	}
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// caches must keep gzip and plain versions apart
+		w.Header().Add("Vary", "Accept-Encoding")
+		g := &gzipWriter{ResponseWriter: w}
+		defer g.close()
+		next.ServeHTTP(g, r)
+	})
+}
+
+// max size of a POST/PUT/PATCH body, MAX_BODY_BYTES to change
+var maxBodyBytes int64 = 1 << 20
+
+// cap request bodies so a huge payload can't eat all memory while decoding
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decode json body, unknown fields are an error so client typos don't get silently dropped
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// sends 413 and returns true when err came from hitting maxBodyBytes
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return true
+	}
+	return false
+}
+
+// turns a handler panic into a 500 instead of killing the connection
+// stack goes to the log, client only gets a generic message
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// net/http uses this one on purpose to abort a response, let it through
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			log.Printf("panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestIDFromContext(r.Context()), p, debug.Stack())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reject requests with too many query params (or one key repeated too many times)
+// counts raw "&" separated pairs so nothing big gets allocated for bad requests
+func queryLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.RawQuery
+		if raw != "" {
+			if strings.Count(raw, "&")+1 > maxQueryParams {
+				http.Error(w, "Too many query parameters", http.StatusBadRequest)
+				return
+			}
+			seen := make(map[string]int)
+			for _, pair := range strings.Split(raw, "&") {
+				key, _, _ := strings.Cut(pair, "=")
+				seen[key]++
+				if seen[key] > maxRepeatedParam {
+					http.Error(w, "Query parameter repeated too many times", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// set to true once startup (db, tables, config) is done
+// /readyz reports 503 until then
+var ready atomic.Bool
+
+// liveness -> process is running, nothing else is checked
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readiness -> startup finished and db answers ping
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "starting"})
+		return
+	}
+	if err := s.db.PingContext(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "database unavailable"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
+// maintenance modes
+// readonly -> reads still work, writes get 503
+// full -> everything except health probes gets 503
+const (
+	maintenanceOff int32 = iota
+	maintenanceReadOnly
+	maintenanceFull
+)
+
+var maintenanceMode atomic.Int32
+var maintenanceRetryAfter = 300 // seconds
+
+func parseMaintenanceMode(v string) int32 {
+	switch strings.ToLower(v) {
+	case "readonly", "read-only":
+		return maintenanceReadOnly
+	case "full", "on":
+		return maintenanceFull
+	default:
+		return maintenanceOff
+	}
+}
+
+// SIGUSR1 toggles read-only maintenance so operators can flip it without restart
+func watchMaintenanceSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			if maintenanceMode.Load() == maintenanceOff {
+				maintenanceMode.Store(maintenanceReadOnly)
+				log.Println("maintenance mode: readonly")
+			} else {
+				maintenanceMode.Store(maintenanceOff)
+				log.Println("maintenance mode: off")
+			}
+		}
+	}()
+}
+
+func maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := maintenanceMode.Load()
+		// probes must keep answering so orchestrator doesn't kill us
+		isProbe := r.URL.Path == "/livez" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+		isRead := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+		if mode == maintenanceFull && !isProbe || mode == maintenanceReadOnly && !isRead {
+			w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			msg := "Service is under maintenance, please try again later"
+			if mode == maintenanceReadOnly {
+				msg = "Service is in read-only maintenance, changes are disabled for now"
+			}
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// info about a route that is going away
+type deprecation struct {
+	Since       time.Time // when it was deprecated
+	Sunset      time.Time // when it will be removed
+	Replacement string    // what clients should use instead
+}
+
+// deprecated routes, key is "METHOD /path/template" as registered on router
+// ex-> "GET /v1/notes/{id}": {Since: ..., Sunset: ..., Replacement: "GET /v2/notes/{id}"}
+var deprecatedRoutes = map[string]deprecation{}
+
+// adds Deprecation, Sunset (RFC 8594) and Warning headers on deprecated routes
+func deprecationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			tmpl, _ := route.GetPathTemplate()
+			if d, ok := deprecatedRoutes[r.Method+" "+tmpl]; ok {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(d.Since.Unix(), 10))
+				if !d.Sunset.IsZero() {
+					w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+				}
+				msg := "this endpoint is deprecated"
+				if d.Replacement != "" {
+					msg += ", use " + d.Replacement
+				}
+				w.Header().Set("Warning", `299 - "`+msg+`"`)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // MAIN Function
-func main() {
-	initDB()
+// requests being served right now, reported when shutting down
+var inFlight atomic.Int64
+
+func inFlightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// set by serve once SIGINT/SIGTERM arrived
+var shuttingDown atomic.Bool
+
+// 503 for anything that still comes in while draining (keep-alive conns, the load balancer
+// not caught up yet), so clients retry on another instance. probes still answer, /readyz says 503 itself
+func shutdownMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isProbe := r.URL.Path == "/livez" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+		if shuttingDown.Load() && !isProbe {
+			w.Header().Set("Retry-After", strconv.Itoa(int(shutdownTimeout/time.Second)))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": "server is shutting down"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middleware around the whole router instead of r.Use: mux runs r.Use middleware only
+// for a matched route, so its own 404/405 would get no request id and no access log line
+// same in every service
+func serverHandler(h http.Handler) http.Handler {
+	return requestIDMiddleware(loggingMiddleware(recoverMiddleware(inFlightMiddleware(shutdownMiddleware(corsMiddleware(h))))))
+}
+
+// how long running requests get to finish after SIGINT/SIGTERM
+var shutdownTimeout = 15 * time.Second
+
+// serve until SIGINT/SIGTERM, then stop accepting connections and wait for running requests
+func serve(srv *http.Server) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	sig := <-stop
+	shuttingDown.Store(true)
+	// tell load balancer to stop sending traffic
+	ready.Store(false)
+	pending := inFlight.Load()
+	log.Printf("got %v, draining %d in-flight requests", sig, pending)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown timed out with %d requests still running: %v", inFlight.Load(), err)
+	} else {
+		log.Printf("drained %d requests, server stopped", pending)
+	}
+}
+
+// router with all middleware and routes
+func (s *Server) Routes() *mux.Router {
 	// create new router
 	// router is responsible for matching incoming req to correct handler
 	r := mux.NewRouter()
-	r.HandleFunc("/notes", createNewNoteHandler).Methods("POST")     // create new note
-	r.HandleFunc("/notes", getNotesHandler).Methods("GET")           // get all notes
-	r.HandleFunc("/notes/{id}", getNoteHandler).Methods("GET")       // get note by ID
-	r.HandleFunc("/notes/{id}", deleteNoteHandler).Methods("DELETE") // delete note by ID
-	r.HandleFunc("/notes/{id}", updateNoteHandler).Methods("PUT")    // update note by ID
+	r.Use(bodyLimitMiddleware)
+	r.Use(queryLimitMiddleware)
+	r.Use(maintenanceMiddleware)
+	r.Use(deprecationMiddleware)
+	r.Use(timeoutMiddleware) // before txMiddleware so a timeout also rolls back the tx
+	r.Use(s.txMiddleware)
+	r.HandleFunc("/livez", livezHandler).Methods("GET")     // process is alive
+	r.HandleFunc("/healthz", livezHandler).Methods("GET")   // same as /livez, for tools expecting this name
+	r.HandleFunc("/readyz", s.readyzHandler).Methods("GET") // can serve traffic
+	// probes above stay unversioned, everything else lives under /v1
+	v1 := r.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/notes", s.createNewNoteHandler).Methods("POST")                                   // create new note
+	v1.Handle("/notes", gzipMiddleware(http.HandlerFunc(s.getNotesHandler))).Methods("GET")           // get all notes
+	v1.HandleFunc("/notes", s.headNotesHandler).Methods("HEAD")                                       // list headers only
+	v1.HandleFunc("/notes/bulk", s.createNotesBulkHandler).Methods("POST")                            // create many notes in one tx
+	v1.HandleFunc("/notes/import", s.importNotesHandler).Methods("POST")                              // json upsert, one tx
+	v1.HandleFunc("/notes/export", s.exportNotesHandler).Methods("GET")                               // csv download
+	v1.HandleFunc("/notes/count", s.countNotesHandler).Methods("GET")                                 // number of notes
+	v1.Handle("/notes/search", gzipMiddleware(http.HandlerFunc(s.searchNotesHandler))).Methods("GET") // search notes (must stay above /notes/{id})
+	v1.HandleFunc("/notes/validate", s.validateNoteHandler).Methods("POST")                           // validate without saving
+	v1.HandleFunc("/notes/{id}", s.getNoteHandler).Methods("GET")                                     // get note by ID
+	v1.HandleFunc("/notes/{id}", s.deleteNoteHandler).Methods("DELETE")                               // delete note by ID
+	v1.HandleFunc("/notes/{id}", s.updateNoteHandler).Methods("PUT")                                  // update note by ID
+	v1.HandleFunc("/notes/{id}/restore", s.restoreNoteHandler).Methods("POST")                        // undo delete
+	v1.HandleFunc("/tags/{old}/rename", s.renameTagHandler).Methods("PUT")                            // rename/merge a tag on all notes
+	return r
+}
+
+func main() {
+	db := initDB()
+	initCursorKey()
+	maxQueryParams = getEnvInt("MAX_QUERY_PARAMS", maxQueryParams)
+	maxRepeatedParam = getEnvInt("MAX_REPEATED_PARAM", maxRepeatedParam)
+	maxSearchResults = getEnvInt("MAX_SEARCH_RESULTS", maxSearchResults)
+	autoTitle = getEnvBool("AUTO_TITLE", autoTitle)
+	requestTimeout = getEnvDuration("REQUEST_TIMEOUT", requestTimeout)
+	shutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", shutdownTimeout)
+	dbTimeout = getEnvDuration("DB_TIMEOUT", dbTimeout)
+	if c := strings.ToUpper(os.Getenv("TITLE_COLLATION")); c != "" {
+		if !slices.Contains(allowedCollations, c) {
+			log.Fatalf("TITLE_COLLATION must be one of %v", allowedCollations)
+		}
+		titleCollation = c
+	}
+	pageSize = getEnvInt("PAGE_SIZE", pageSize)
+	maxPageSize = getEnvInt("MAX_PAGE_SIZE", maxPageSize)
+	maintenanceMode.Store(parseMaintenanceMode(os.Getenv("MAINTENANCE_MODE")))
+	maintenanceRetryAfter = getEnvInt("MAINTENANCE_RETRY_AFTER", maintenanceRetryAfter)
+	watchMaintenanceSignal()
+	setLogFormat(os.Getenv("LOG_FORMAT"))
+	parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	maxBodyBytes = int64(getEnvInt("MAX_BODY_BYTES", int(maxBodyBytes)))
+	s := NewServer(db)
 	//start server
-	fmt.Println("Server running on local host: 8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	ready.Store(true)
+	fmt.Println("Server running on local host: 8080, api at /v1")
+	srv := &http.Server{Addr: ":8080", Handler: serverHandler(s.Routes())}
+	serve(srv)
+	if err := db.Close(); err != nil {
+		log.Printf("closing db: %v", err)
+	}
 }
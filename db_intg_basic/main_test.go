@@ -0,0 +1,1109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// server on a fresh in-memory db with the real migrations, pool settings and routes
+func newTestServer(t *testing.T) (*Server, http.Handler) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configurePool(db)
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	initCursorKey()
+	s := NewServer(db)
+	return s, serverHandler(s.Routes())
+}
+
+func doRequest(h http.Handler, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func createTestNotes(t *testing.T, h http.Handler, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		rec := doRequest(h, "POST", "/v1/notes", fmt.Sprintf(`{"title":"note %d","content":"content %d"}`, i, i))
+		if rec.Code/100 != 2 {
+			t.Fatal(rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func decodeNotes(t *testing.T, rec *httptest.ResponseRecorder) []Note {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	var notes []Note
+	if err := json.Unmarshal(rec.Body.Bytes(), &notes); err != nil {
+		t.Fatal(err, rec.Body.String())
+	}
+	return notes
+}
+
+func TestCursorWalksAllPages(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 23)
+	seen := map[int]bool{}
+	pages := 0
+	path := "/v1/notes?limit=5"
+	for path != "" {
+		rec := doRequest(h, "GET", path, "")
+		notes := decodeNotes(t, rec)
+		pages++
+		for _, n := range notes {
+			if seen[n.ID] {
+				t.Fatalf("note %d on two pages", n.ID)
+			}
+			seen[n.ID] = true
+		}
+		path = ""
+		if c := rec.Header().Get("X-Next-Cursor"); c != "" {
+			path = "/v1/notes?limit=5&cursor=" + c
+		}
+		if pages > 10 {
+			t.Fatal("cursor never ends")
+		}
+	}
+	if len(seen) != 23 || pages != 5 {
+		t.Fatal(len(seen), pages)
+	}
+}
+
+func TestTamperedCursor(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 3)
+	rec := doRequest(h, "GET", "/v1/notes?limit=1", "")
+	cursor := rec.Header().Get("X-Next-Cursor")
+	if cursor == "" {
+		t.Fatal("no cursor")
+	}
+	payload, sig, _ := strings.Cut(cursor, ".")
+	forged := encodeCursor(cursorState{LastID: 0})
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for _, bad := range []string{
+		"abc",
+		payload,                   // signature dropped
+		forgedPayload + "." + sig, // other payload, old signature
+		payload + "." + sig[:len(sig)-2] + "AA",
+	} {
+		if rec := doRequest(h, "GET", "/v1/notes?cursor="+bad, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("cursor %q: %d", bad, rec.Code)
+		}
+	}
+	// sorted lists page with ?page, a cursor (last id) means nothing there
+	if rec := doRequest(h, "GET", "/v1/notes?sort=title&cursor="+cursor, ""); rec.Code != http.StatusBadRequest {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestPageAndUnpagedList(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 12)
+	if notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes", "")); len(notes) != 12 {
+		t.Fatal(len(notes))
+	}
+	notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes?page=3&limit=5", ""))
+	if len(notes) != 2 || notes[0].ID != 11 {
+		t.Fatal(notes)
+	}
+	for _, q := range []string{"page=0", "page=x", "limit=-1"} {
+		if rec := doRequest(h, "GET", "/v1/notes?"+q, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", q, rec.Code)
+		}
+	}
+}
+
+func TestDefaultPageSizeHeader(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 30)
+	tests := []struct {
+		header string
+		query  string
+		want   int
+	}{
+		{"3", "", 3},
+		{"3", "limit=7", 7}, // explicit limit wins
+		{"3", "page=2", 3},
+		{"100", "", 30},
+		{"101", "", pageSize}, // above maxPageSize
+		{"0", "", pageSize},
+		{"-2", "", pageSize},
+		{"abc", "", pageSize},
+		{"", "page=1", pageSize},
+	}
+	for _, tt := range tests {
+		var hdr []string
+		if tt.header != "" {
+			hdr = []string{"X-Default-Page-Size", tt.header}
+		}
+		notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes?"+tt.query, "", hdr...))
+		if len(notes) != tt.want {
+			t.Errorf("header %q query %q: got %d notes, want %d", tt.header, tt.query, len(notes), tt.want)
+		}
+	}
+}
+
+func decodeNote(t *testing.T, rec *httptest.ResponseRecorder) Note {
+	t.Helper()
+	if rec.Code/100 != 2 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	var n Note
+	if err := json.Unmarshal(rec.Body.Bytes(), &n); err != nil {
+		t.Fatal(err, rec.Body.String())
+	}
+	return n
+}
+
+func TestNoteTags(t *testing.T) {
+	_, h := newTestServer(t)
+	n := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"a","content":"b","tags":[" go ","db","go"]}`))
+	if got := strings.Join(n.Tags, ","); got != "db,go" {
+		t.Fatalf("created tags = %q, want db,go", got)
+	}
+	path := fmt.Sprintf("/v1/notes/%d", n.ID)
+
+	// no tags in the body keeps them
+	n = decodeNote(t, doRequest(h, "PUT", path, `{"title":"a2","content":"b"}`))
+	if got := strings.Join(n.Tags, ","); got != "db,go" {
+		t.Fatalf("tags after update without tags = %q, want db,go", got)
+	}
+	// a new set only touches the difference
+	n = decodeNote(t, doRequest(h, "PUT", path, `{"title":"a2","content":"b","tags":["go","web"]}`))
+	if got := strings.Join(n.Tags, ","); got != "go,web" {
+		t.Fatalf("tags after update = %q, want go,web", got)
+	}
+	n = decodeNote(t, doRequest(h, "GET", path, ""))
+	if got := strings.Join(n.Tags, ","); got != "go,web" {
+		t.Fatalf("stored tags = %q, want go,web", got)
+	}
+	if notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes?tag=web", "")); len(notes) != 1 || notes[0].ID != n.ID {
+		t.Fatalf("?tag=web returned %v", notes)
+	}
+	if notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes?tag=db", "")); len(notes) != 0 {
+		t.Fatalf("?tag=db after removing it returned %v", notes)
+	}
+	// [] removes all
+	n = decodeNote(t, doRequest(h, "PUT", path, `{"title":"a2","content":"b","tags":[]}`))
+	if len(n.Tags) != 0 {
+		t.Fatalf("tags after [] = %v, want none", n.Tags)
+	}
+	if notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes?tag=go", "")); len(notes) != 0 {
+		t.Fatalf("?tag=go after removing all returned %v", notes)
+	}
+	// an untagged note still has the field, as an empty list
+	if body := doRequest(h, "GET", path, "").Body.String(); !strings.Contains(body, `"tags":[]`) {
+		t.Fatalf("untagged note body = %s, want \"tags\":[]", body)
+	}
+}
+
+func TestRenameTag(t *testing.T) {
+	_, h := newTestServer(t)
+	a := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"a","content":"c","tags":["old"]}`))
+	b := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"b","content":"c","tags":["old","keep"]}`))
+	rename := func(old, body string) (int, map[string]any) {
+		rec := doRequest(h, "PUT", "/v1/tags/"+old+"/rename", body)
+		var resp map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	if code, resp := rename("old", `{"name":"new"}`); code != http.StatusOK || resp["notes_affected"] != float64(2) {
+		t.Fatalf("rename = %d %v, want 200 with 2 notes", code, resp)
+	}
+	for id, want := range map[int]string{a.ID: "new", b.ID: "keep,new"} {
+		if got := strings.Join(decodeNote(t, doRequest(h, "GET", fmt.Sprintf("/v1/notes/%d", id), "")).Tags, ","); got != want {
+			t.Fatalf("note %d tags = %q, want %q", id, got, want)
+		}
+	}
+	if code, _ := rename("old", `{"name":"x"}`); code != http.StatusNotFound {
+		t.Fatalf("rename of a gone tag = %d, want 404", code)
+	}
+	if code, _ := rename("new", `{"name":" "}`); code != http.StatusBadRequest {
+		t.Fatalf("empty new name = %d, want 400", code)
+	}
+}
+
+func TestRenameTagMerges(t *testing.T) {
+	s, h := newTestServer(t)
+	a := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"a","content":"c","tags":["golang"]}`))
+	b := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"b","content":"c","tags":["golang","go"]}`))
+	c := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"c","content":"c","tags":["go"]}`))
+
+	rec := doRequest(h, "PUT", "/v1/tags/golang/rename", `{"name":"go"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"notes_affected":2`) {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	for _, id := range []int{a.ID, b.ID, c.ID} {
+		if got := decodeNote(t, doRequest(h, "GET", fmt.Sprintf("/v1/notes/%d", id), "")).Tags; !slices.Equal(got, []string{"go"}) {
+			t.Fatalf("note %d tags = %v, want just go", id, got)
+		}
+	}
+	var tags int
+	s.db.QueryRow("SELECT COUNT(*) FROM tags WHERE name = 'golang'").Scan(&tags)
+	if tags != 0 {
+		t.Fatal("old tag row left after merge")
+	}
+	if notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes?tag=go", "")); len(notes) != 3 {
+		t.Fatalf("?tag=go returned %d notes, want 3", len(notes))
+	}
+}
+
+func TestBulkAndImportStoreTags(t *testing.T) {
+	_, h := newTestServer(t)
+	rec := doRequest(h, "POST", "/v1/notes/bulk", `[{"title":"a","content":"b","tags":["x","y"]},{"title":"c","content":"d"}]`)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	bulk := decodeNotes(t, rec)
+	for _, n := range bulk {
+		got := decodeNote(t, doRequest(h, "GET", fmt.Sprintf("/v1/notes/%d", n.ID), ""))
+		if !slices.Equal(got.Tags, n.Tags) {
+			t.Fatalf("note %d: stored tags %v, bulk response %v", n.ID, got.Tags, n.Tags)
+		}
+	}
+	if len(bulk) != 2 || strings.Join(bulk[0].Tags, ",") != "x,y" || len(bulk[1].Tags) != 0 {
+		t.Fatalf("bulk response = %v", bulk)
+	}
+
+	// update of note 1 with new tags, update of note 2 without tags, one new tagged note
+	body := fmt.Sprintf(`[{"id":%d,"title":"a","content":"b","tags":["z"]},{"id":%d,"title":"c2","content":"d"},{"title":"e","content":"f","tags":["x"]}]`, bulk[0].ID, bulk[1].ID)
+	if rec := doRequest(h, "POST", "/v1/notes/import", body); rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	want := map[string]string{"a": "z", "c2": "", "e": "x"}
+	for _, n := range decodeNotes(t, doRequest(h, "GET", "/v1/notes", "")) {
+		if got := strings.Join(n.Tags, ","); got != want[n.Title] {
+			t.Fatalf("note %q tags = %q, want %q", n.Title, got, want[n.Title])
+		}
+	}
+}
+
+func TestCountTagFilter(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 2)
+	doRequest(h, "POST", "/v1/notes", `{"title":"work one","content":"y","tags":["work"]}`)
+	doRequest(h, "POST", "/v1/notes", `{"title":"work two","content":"y","tags":["work"]}`)
+	doRequest(h, "DELETE", "/v1/notes/4", "")
+	for path, want := range map[string]int{
+		"/v1/notes/count":                               3,
+		"/v1/notes/count?tag=work":                      1,
+		"/v1/notes/count?tag=work&include_deleted=true": 2,
+		"/v1/notes/count?tag=work&q=one":                1,
+		"/v1/notes/count?tag=none":                      0,
+	} {
+		rec := doRequest(h, "GET", path, "")
+		var got map[string]int
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(path, rec.Code, err)
+		}
+		if got["count"] != want {
+			t.Fatalf("%s count = %d, want %d", path, got["count"], want)
+		}
+	}
+}
+
+func TestListTagFilter(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 3)
+	tagged := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"x","content":"y","tags":["work"]}`))
+	decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"x2","content":"y2","tags":["home"]}`))
+
+	rec := doRequest(h, "GET", "/v1/notes?tag=work", "")
+	notes := decodeNotes(t, rec)
+	if len(notes) != 1 || notes[0].ID != tagged.ID {
+		t.Fatalf("?tag=work returned %v", notes)
+	}
+	if got := rec.Header().Get("X-Total-Count"); got != "1" {
+		t.Fatalf("X-Total-Count = %s, want 1", got)
+	}
+	head := doRequest(h, "HEAD", "/v1/notes?tag=work", "")
+	if got := head.Header().Get("X-Total-Count"); got != "1" {
+		t.Fatalf("HEAD X-Total-Count = %s, want 1", got)
+	}
+	if got := doRequest(h, "GET", "/v1/notes", "").Header().Get("X-Total-Count"); got != "5" {
+		t.Fatalf("unfiltered X-Total-Count = %s, want 5", got)
+	}
+	if notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes?tag=none", "")); len(notes) != 0 {
+		t.Fatalf("?tag=none returned %v", notes)
+	}
+}
+
+func TestListETagChangesWithTags(t *testing.T) {
+	_, h := newTestServer(t)
+	n := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"a","content":"b","tags":["one"]}`))
+	before := doRequest(h, "HEAD", "/v1/notes", "").Header().Get("ETag")
+	// same title/content, only the tag changes
+	decodeNote(t, doRequest(h, "PUT", fmt.Sprintf("/v1/notes/%d", n.ID), `{"title":"a","content":"b","tags":["two"]}`))
+	after := doRequest(h, "HEAD", "/v1/notes", "").Header().Get("ETag")
+	if before == "" || before == after {
+		t.Fatalf("list etag did not change with tags: %q -> %q", before, after)
+	}
+}
+
+func TestDeleteRestore(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 3)
+
+	if rec := doRequest(h, "DELETE", "/v1/notes/2", ""); rec.Code != http.StatusNoContent {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "GET", "/v1/notes/2", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET deleted note = %d, want 404", rec.Code)
+	}
+	rec := doRequest(h, "GET", "/v1/notes", "")
+	if notes := decodeNotes(t, rec); len(notes) != 2 || rec.Header().Get("X-Total-Count") != "2" {
+		t.Fatalf("after delete: %d notes, X-Total-Count %s, want 2", len(notes), rec.Header().Get("X-Total-Count"))
+	}
+	rec = doRequest(h, "GET", "/v1/notes?include_deleted=true", "")
+	notes := decodeNotes(t, rec)
+	if len(notes) != 3 || rec.Header().Get("X-Total-Count") != "3" {
+		t.Fatalf("include_deleted: %d notes, X-Total-Count %s, want 3", len(notes), rec.Header().Get("X-Total-Count"))
+	}
+	for _, n := range notes {
+		if (n.ID == 2) != (n.DeletedAt != nil) {
+			t.Fatalf("note %d deleted_at = %v", n.ID, n.DeletedAt)
+		}
+	}
+	if rec := doRequest(h, "HEAD", "/v1/notes?include_deleted=true", ""); rec.Header().Get("X-Total-Count") != "3" {
+		t.Fatalf("HEAD include_deleted X-Total-Count = %s, want 3", rec.Header().Get("X-Total-Count"))
+	}
+
+	if n := decodeNote(t, doRequest(h, "POST", "/v1/notes/2/restore", "")); n.ID != 2 || n.Title != "note 2" {
+		t.Fatalf("restored %+v", n)
+	}
+	if rec := doRequest(h, "GET", "/v1/notes/2", ""); rec.Code != http.StatusOK {
+		t.Fatalf("GET restored note = %d, want 200", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/v1/notes", ""); rec.Header().Get("X-Total-Count") != "3" {
+		t.Fatalf("after restore X-Total-Count = %s, want 3", rec.Header().Get("X-Total-Count"))
+	}
+	// live note: nothing to restore
+	if rec := doRequest(h, "POST", "/v1/notes/2/restore", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("restore of live note = %d, want 404", rec.Code)
+	}
+}
+
+func TestDoubleDelete(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 1)
+	if rec := doRequest(h, "DELETE", "/v1/notes/1", ""); rec.Code != http.StatusNoContent {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, "DELETE", "/v1/notes/1", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("second delete = %d, want 404", rec.Code)
+	}
+}
+
+func countNotes(t *testing.T, s *Server) int {
+	t.Helper()
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM notes").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestTxRollsBackOnHandlerError(t *testing.T) {
+	s, _ := newTestServer(t)
+	insertThen := func(finish func(w http.ResponseWriter)) http.Handler {
+		return s.txMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := s.dbFrom(r)
+			for _, title := range []string{"first", "second"} {
+				if _, err := q.ExecContext(r.Context(), "INSERT INTO notes (title, content) VALUES (?, 'x')", title); err != nil {
+					t.Error(err)
+				}
+			}
+			finish(w)
+		}))
+	}
+
+	// error after both inserts -> neither is kept
+	rec := doRequest(insertThen(func(w http.ResponseWriter) { http.Error(w, "boom", http.StatusInternalServerError) }), "POST", "/", "")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatal(rec.Code)
+	}
+	if n := countNotes(t, s); n != 0 {
+		t.Fatalf("%d notes after handler error, want 0", n)
+	}
+
+	// panic -> rolled back too
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic was swallowed")
+			}
+		}()
+		doRequest(insertThen(func(w http.ResponseWriter) { panic("boom") }), "POST", "/", "")
+	}()
+	if n := countNotes(t, s); n != 0 {
+		t.Fatalf("%d notes after panic, want 0", n)
+	}
+
+	// 2xx -> both committed
+	doRequest(insertThen(func(w http.ResponseWriter) { w.WriteHeader(http.StatusCreated) }), "POST", "/", "")
+	if n := countNotes(t, s); n != 2 {
+		t.Fatalf("%d notes after success, want 2", n)
+	}
+}
+
+func TestBulkCreatePersistsAll(t *testing.T) {
+	s, h := newTestServer(t)
+	created := decodeNotes(t, doRequest(h, "POST", "/v1/notes/bulk", `[{"title":"a","content":"1"},{"title":"b","content":"2"},{"title":"c","content":"3"}]`))
+	if len(created) != 3 {
+		t.Fatalf("bulk returned %d notes, want 3", len(created))
+	}
+	for _, n := range created {
+		if n.ID == 0 {
+			t.Fatalf("bulk note without id: %+v", n)
+		}
+		got := decodeNote(t, doRequest(h, "GET", fmt.Sprintf("/v1/notes/%d", n.ID), ""))
+		if got.Title != n.Title || got.Content != n.Content {
+			t.Fatalf("stored note %+v, bulk response %+v", got, n)
+		}
+	}
+	if n := countNotes(t, s); n != 3 {
+		t.Fatalf("%d notes after bulk create, want 3", n)
+	}
+}
+
+func TestBulkCreateRollsBackOnInvalidNote(t *testing.T) {
+	s, h := newTestServer(t)
+	rec := doRequest(h, "POST", "/v1/notes/bulk", `[{"title":"ok","content":"ok"},{"title":"","content":""}]`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if n := countNotes(t, s); n != 0 {
+		t.Fatalf("%d notes after failed bulk create, want 0", n)
+	}
+}
+
+func TestUpdateByPathID(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 2)
+	// no id in the body, the path decides
+	n := decodeNote(t, doRequest(h, "PUT", "/v1/notes/2", `{"title":"changed","content":"new content"}`))
+	if n.ID != 2 || n.Title != "changed" {
+		t.Fatalf("update returned %+v", n)
+	}
+	if n := decodeNote(t, doRequest(h, "GET", "/v1/notes/2", "")); n.Title != "changed" || n.Content != "new content" {
+		t.Fatalf("stored %+v", n)
+	}
+	// a different id in the body is ignored
+	decodeNote(t, doRequest(h, "PUT", "/v1/notes/2", `{"id":1,"title":"again","content":"c"}`))
+	if n := decodeNote(t, doRequest(h, "GET", "/v1/notes/1", "")); n.Title != "note 1" {
+		t.Fatalf("note 1 was changed through the body id: %+v", n)
+	}
+}
+
+func TestMissingNote404(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 1)
+	if rec := doRequest(h, "PUT", "/v1/notes/999", `{"title":"t","content":"c"}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("update of missing note = %d, want 404", rec.Code)
+	}
+	if rec := doRequest(h, "DELETE", "/v1/notes/999", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete of missing note = %d, want 404", rec.Code)
+	}
+}
+
+func TestValidateNoteLimits(t *testing.T) {
+	_, h := newTestServer(t)
+	tests := []struct {
+		name    string
+		note    Note
+		invalid string // field expected in the errors, "" = valid
+	}{
+		{"title at limit", Note{Title: strings.Repeat("a", maxTitleLen), Content: "c"}, ""},
+		{"title over limit", Note{Title: strings.Repeat("a", maxTitleLen+1), Content: "c"}, "title"},
+		// limits count runes, not bytes
+		{"multibyte title at limit", Note{Title: strings.Repeat("é", maxTitleLen), Content: "c"}, ""},
+		{"empty title", Note{Title: "", Content: "c"}, "title"},
+		{"blank title", Note{Title: "   ", Content: "c"}, "title"},
+		{"content at limit", Note{Title: "t", Content: strings.Repeat("a", maxContentLen)}, ""},
+		{"content over limit", Note{Title: "t", Content: strings.Repeat("a", maxContentLen+1)}, "content"},
+		{"empty content", Note{Title: "t", Content: ""}, "content"},
+		{"tag at limit", Note{Title: "t", Content: "c", Tags: []string{strings.Repeat("a", maxTagLen)}}, ""},
+		{"tag over limit", Note{Title: "t", Content: "c", Tags: []string{strings.Repeat("a", maxTagLen+1)}}, "tags"},
+		{"empty tag", Note{Title: "t", Content: "c", Tags: []string{""}}, "tags"},
+		{"no tags", Note{Title: "t", Content: "c", Tags: []string{}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateNote(tt.note)
+			if tt.invalid == "" && len(errs) != 0 {
+				t.Fatalf("want valid, got %v", errs)
+			}
+			if tt.invalid != "" && (len(errs) != 1 || errs[tt.invalid] == "") {
+				t.Fatalf("want only %s invalid, got %v", tt.invalid, errs)
+			}
+			body, _ := json.Marshal(tt.note)
+			rec := doRequest(h, "POST", "/v1/notes", string(body))
+			if want := map[bool]int{true: http.StatusOK, false: http.StatusBadRequest}[tt.invalid == ""]; rec.Code != want {
+				t.Fatalf("POST /v1/notes = %d, want %d: %s", rec.Code, want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHeadListHeaders(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 3)
+	head := doRequest(h, "HEAD", "/v1/notes", "")
+	if head.Code != http.StatusOK {
+		t.Fatal(head.Code)
+	}
+	if head.Body.Len() != 0 {
+		t.Fatalf("HEAD body = %q, want empty", head.Body.String())
+	}
+	get := doRequest(h, "GET", "/v1/notes", "")
+	for _, name := range []string{"X-Total-Count", "ETag", "Last-Modified"} {
+		if v := head.Header().Get(name); v == "" || v != get.Header().Get(name) {
+			t.Fatalf("%s: HEAD %q, GET %q", name, v, get.Header().Get(name))
+		}
+	}
+	if head.Header().Get("X-Total-Count") != "3" {
+		t.Fatalf("X-Total-Count = %s, want 3", head.Header().Get("X-Total-Count"))
+	}
+	if _, err := http.ParseTime(head.Header().Get("Last-Modified")); err != nil {
+		t.Fatalf("Last-Modified %q: %v", head.Header().Get("Last-Modified"), err)
+	}
+}
+
+// notes.db from before migrations, when initDB added created_at on its own
+func TestSearchTruncated(t *testing.T) {
+	old := maxSearchResults
+	maxSearchResults = 3
+	defer func() { maxSearchResults = old }()
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 5)
+
+	rec := doRequest(h, "GET", "/v1/notes/search?q=note", "")
+	if notes := decodeNotes(t, rec); len(notes) != 3 {
+		t.Fatalf("got %d notes, want the cap of 3", len(notes))
+	}
+	if got := rec.Header().Get("X-Truncated"); got != "true" {
+		t.Fatalf("X-Truncated = %q, want true", got)
+	}
+	// under the cap: everything, no header
+	rec = doRequest(h, "GET", "/v1/notes/search?q=note+1", "")
+	if notes := decodeNotes(t, rec); len(notes) != 1 {
+		t.Fatalf("got %d notes, want 1", len(notes))
+	}
+	if got := rec.Header().Get("X-Truncated"); got != "" {
+		t.Fatalf("X-Truncated = %q on a whole result", got)
+	}
+}
+
+func TestMigrateExistingColumn(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	configurePool(db)
+	if _, err := db.Exec("CREATE TABLE notes (id INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT NOT NULL, content TEXT NOT NULL, created_at DATETIME)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&n)
+	if n != len(migrations) {
+		t.Fatalf("%d migrations recorded, want %d", n, len(migrations))
+	}
+	for _, col := range []string{"created_at", "deleted_at", "updated_at"} {
+		if _, err := db.Exec("SELECT " + col + " FROM notes"); err != nil {
+			t.Fatal(col, err)
+		}
+	}
+}
+
+func TestUpdatedAtBackfill(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	configurePool(db)
+	// a db stopped at version 4, written before updated_at existed
+	all := migrations
+	migrations = all[:4]
+	err = migrate(db)
+	migrations = all
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO notes (title, content, created_at) VALUES ('old', 'c', '2024-03-01 10:00:00')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	initCursorKey()
+	h := NewServer(db).Routes()
+	if got := doRequest(h, "HEAD", "/v1/notes", "").Header().Get("Last-Modified"); got != "Fri, 01 Mar 2024 10:00:00 GMT" {
+		t.Fatalf("Last-Modified = %q, want created_at of the old note", got)
+	}
+	// a tag change alone counts as a change of the note
+	if err := setNoteTags(context.Background(), db, 1, []string{"new"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := doRequest(h, "HEAD", "/v1/notes", "").Header().Get("Last-Modified"); got == "Fri, 01 Mar 2024 10:00:00 GMT" {
+		t.Fatal("Last-Modified did not move on a tag change")
+	}
+}
+
+func TestListGzip(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 40) // well over gzipMinSize as json
+	plain := doRequest(h, "GET", "/v1/notes", "")
+	rec := doRequest(h, "GET", "/v1/notes", "", "Accept-Encoding", "gzip")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("status %d, Content-Encoding %q, want gzip", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	if !slices.Contains(rec.Header().Values("Vary"), "Accept-Encoding") {
+		t.Fatalf("Vary = %v, want Accept-Encoding", rec.Header().Values("Vary"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != plain.Body.String() {
+		t.Fatal("gunzipped body differs from the plain response")
+	}
+	var notes []Note
+	if err := json.Unmarshal(body, &notes); err != nil || len(notes) != 40 {
+		t.Fatalf("decoded %d notes, %v", len(notes), err)
+	}
+
+	// small responses go out as they are
+	small := doRequest(h, "GET", "/v1/notes?limit=1", "", "Accept-Encoding", "gzip")
+	if small.Header().Get("Content-Encoding") != "" {
+		t.Fatal("one note was compressed")
+	}
+	decodeNotes(t, small)
+}
+
+func TestRouterErrorsLogged(t *testing.T) {
+	_, h := newTestServer(t)
+	var buf bytes.Buffer
+	defer func(l *slog.Logger) { accessLog = l }(accessLog)
+	accessLog = slog.New(slog.NewJSONHandler(&buf, nil))
+
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/nope", http.StatusNotFound},
+		{"POST", "/livez", http.StatusMethodNotAllowed},
+		{"GET", "/v1/notes", http.StatusOK},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		rec := doRequest(h, tt.method, tt.path, "", "X-Request-ID", "req-"+tt.method)
+		if rec.Code != tt.status {
+			t.Fatalf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+		}
+		if rec.Header().Get("X-Request-ID") != "req-"+tt.method {
+			t.Fatalf("%s %s: X-Request-ID %q", tt.method, tt.path, rec.Header().Get("X-Request-ID"))
+		}
+		var line struct {
+			RequestID string `json:"request_id"`
+			Path      string `json:"path"`
+			Status    int    `json:"status"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("%s %s: no access log line: %q", tt.method, tt.path, buf.String())
+		}
+		if line.Status != tt.status || line.Path != tt.path || line.RequestID != "req-"+tt.method {
+			t.Fatalf("%s %s logged %+v", tt.method, tt.path, line)
+		}
+	}
+}
+
+// while draining, requests get 503 + Retry-After, probes still answer
+func TestShutdownRejectsNewRequests(t *testing.T) {
+	_, h := newTestServer(t)
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/notes", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("during shutdown: %d, Retry-After %q, want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("probe during shutdown = %d, want 200", rec.Code)
+	}
+	shuttingDown.Store(false)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/notes", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("before shutdown = %d, want 200", rec.Code)
+	}
+}
+
+func TestDeprecatedRouteHeaders(t *testing.T) {
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	deprecatedRoutes["GET /v1/notes/count"] = deprecation{Since: since, Sunset: sunset, Replacement: "X-Total-Count of HEAD /v1/notes"}
+	defer delete(deprecatedRoutes, "GET /v1/notes/count")
+	_, h := newTestServer(t)
+
+	rec := doRequest(h, "GET", "/v1/notes/count", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if got, want := rec.Header().Get("Deprecation"), fmt.Sprintf("@%d", since.Unix()); got != want {
+		t.Fatalf("Deprecation = %q, want %q", got, want)
+	}
+	if got := rec.Header().Get("Sunset"); got != "Thu, 31 Dec 2026 00:00:00 GMT" {
+		t.Fatalf("Sunset = %q", got)
+	}
+	if got := rec.Header().Get("Warning"); got != `299 - "this endpoint is deprecated, use X-Total-Count of HEAD /v1/notes"` {
+		t.Fatalf("Warning = %q", got)
+	}
+	// other routes are untouched
+	for _, path := range []string{"/v1/notes", "/v1/notes/search?q=x"} {
+		if rec := doRequest(h, "GET", path, ""); rec.Header().Get("Deprecation") != "" || rec.Header().Get("Warning") != "" {
+			t.Fatalf("%s has deprecation headers", path)
+		}
+	}
+}
+
+func TestRequestTimeout504(t *testing.T) {
+	defer func(d time.Duration) { requestTimeout = d }(requestTimeout)
+	requestTimeout = 20 * time.Millisecond
+	cancelled := make(chan struct{})
+	slow := timeoutMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("too late"))
+	}))
+	rec := doRequest(slow, "GET", "/v1/notes", "")
+	if rec.Code != http.StatusGatewayTimeout || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("slow handler = %d %q, want 504 json", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] != "request timed out" {
+		t.Fatalf("body = %s", rec.Body.String())
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context was never cancelled")
+	}
+
+	// a fast handler is passed through as is
+	fast := timeoutMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	if rec := doRequest(fast, "GET", "/v1/notes", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("fast handler = %d, want 201", rec.Code)
+	}
+}
+
+func TestRawRange(t *testing.T) {
+	_, h := newTestServer(t)
+	n := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"t","content":"0123456789"}`))
+	path := fmt.Sprintf("/v1/notes/%d?raw=true", n.ID)
+
+	rec := doRequest(h, "GET", path, "", "Range", "bytes=2-5")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Fatalf("range = %d %q, want 206 2345", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Fatalf("Content-Range = %q, want bytes 2-5/10", got)
+	}
+	// past the end of the content
+	rec = doRequest(h, "GET", path, "", "Range", "bytes=20-30")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("unsatisfiable range = %d, want 416", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes */10" {
+		t.Fatalf("416 Content-Range = %q, want bytes */10", got)
+	}
+	// no Range -> whole content
+	if rec := doRequest(h, "GET", path, ""); rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Fatalf("without range = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUpdateIfMatch(t *testing.T) {
+	_, h := newTestServer(t)
+	n := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"a","content":"b","tags":["x"]}`))
+	path := fmt.Sprintf("/v1/notes/%d", n.ID)
+	etag := doRequest(h, "GET", path, "").Header().Get("ETag")
+
+	rec := doRequest(h, "PUT", path, `{"title":"a2","content":"b"}`, "If-Match", etag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("matching If-Match = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	// etag from before that update is stale now
+	if rec := doRequest(h, "PUT", path, `{"title":"a3","content":"b"}`, "If-Match", etag); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale If-Match = %d, want 412", rec.Code)
+	}
+	// a change of the tags alone changes the etag too
+	current := doRequest(h, "GET", path, "").Header().Get("ETag")
+	doRequest(h, "PUT", path, `{"title":"a2","content":"b","tags":["y"]}`)
+	if got := doRequest(h, "GET", path, "").Header().Get("ETag"); got == current {
+		t.Fatal("etag did not change with the tags")
+	}
+	if rec := doRequest(h, "PUT", path, `{"title":"a2","content":"b"}`, "If-Match", current); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("If-Match from before the tag change = %d, want 412", rec.Code)
+	}
+	if got := decodeNote(t, doRequest(h, "GET", path, "")); got.Title != "a2" || strings.Join(got.Tags, ",") != "y" {
+		t.Fatalf("note after rejected updates = %+v", got)
+	}
+}
+
+// a panicking handler gets a json 500, the server keeps serving the next requests
+func TestPanicRecovered(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	r.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	srv := httptest.NewServer(serverHandler(r))
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/panic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]string
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Content-Type") != "application/json" || body["error"] == "" {
+			t.Fatalf("panic = %d %q %v, want json 500", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+		resp, err = http.Get(srv.URL + "/ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("after a panic = %d, want 200", resp.StatusCode)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	defer ready.Store(ready.Load())
+	s, h := newTestServer(t)
+	ready.Store(false)
+	if rec := doRequest(h, "GET", "/readyz", ""); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "starting") {
+		t.Fatalf("before init = %d %s, want 503 starting", rec.Code, rec.Body.String())
+	}
+	ready.Store(true)
+	if rec := doRequest(h, "GET", "/readyz", ""); rec.Code != http.StatusOK {
+		t.Fatalf("after init = %d %s, want 200", rec.Code, rec.Body.String())
+	}
+	// db gone -> not ready anymore
+	s.db.Close()
+	if rec := doRequest(h, "GET", "/readyz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("with closed db = %d, want 503", rec.Code)
+	}
+}
+
+func TestSortTitleIgnoresCase(t *testing.T) {
+	_, h := newTestServer(t)
+	for _, title := range []string{"cherry", "Banana", "apple"} {
+		if rec := doRequest(h, "POST", "/v1/notes", fmt.Sprintf(`{"title":%q,"content":"x"}`, title)); rec.Code/100 != 2 {
+			t.Fatal(rec.Code, rec.Body.String())
+		}
+	}
+	notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes?sort=title&order=asc", ""))
+	var titles []string
+	for _, n := range notes {
+		titles = append(titles, n.Title)
+	}
+	if got := strings.Join(titles, ","); got != "apple,Banana,cherry" {
+		t.Fatalf("sort=title gave %s, want apple,Banana,cherry", got)
+	}
+}
+
+func TestListFields(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 2)
+
+	rec := doRequest(h, "GET", "/v1/notes?fields=title", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	var items []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil {
+		t.Fatal(err, rec.Body.String())
+	}
+	if len(items) != 2 {
+		t.Fatalf("got %d notes, want 2", len(items))
+	}
+	for _, item := range items {
+		if _, ok := item["content"]; ok {
+			t.Fatalf("content returned without being asked for: %v", item)
+		}
+		if item["id"] == nil || item["title"] == nil || len(item) != 2 {
+			t.Fatalf("want only id and title, got %v", item)
+		}
+	}
+
+	if rec := doRequest(h, "GET", "/v1/notes?fields=title,password", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown field = %d, want 400", rec.Code)
+	}
+}
+
+func TestQueryParamLimit(t *testing.T) {
+	_, h := newTestServer(t)
+	params := make([]string, maxQueryParams+1)
+	for i := range params {
+		params[i] = fmt.Sprintf("p%d=1", i)
+	}
+	if rec := doRequest(h, "GET", "/v1/notes?"+strings.Join(params, "&"), ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("%d params = %d, want 400", len(params), rec.Code)
+	}
+	repeated := strings.Repeat("tag=a&", maxRepeatedParam) + "tag=a"
+	if rec := doRequest(h, "GET", "/v1/notes?"+repeated, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("repeated key = %d, want 400", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/v1/notes?limit=5&sort=title", ""); rec.Code != http.StatusOK {
+		t.Fatalf("normal query = %d, want 200", rec.Code)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	_, h := newTestServer(t)
+	createTestNotes(t, h, 1)
+	t.Cleanup(func() { maintenanceMode.Store(maintenanceOff) })
+
+	maintenanceMode.Store(maintenanceReadOnly)
+	rec := doRequest(h, "POST", "/v1/notes", `{"title":"blocked","content":"x"}`)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("write in read-only = %d (Retry-After %q), want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes", "")); len(notes) != 1 {
+		t.Fatalf("read in read-only gave %d notes, want 1", len(notes))
+	}
+
+	maintenanceMode.Store(maintenanceFull)
+	if rec := doRequest(h, "GET", "/v1/notes", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("read in full maintenance = %d, want 503", rec.Code)
+	}
+	if rec := doRequest(h, "GET", "/livez", ""); rec.Code != http.StatusOK {
+		t.Fatalf("probe in full maintenance = %d, want 200", rec.Code)
+	}
+
+	maintenanceMode.Store(maintenanceOff)
+	if rec := doRequest(h, "POST", "/v1/notes", `{"title":"allowed","content":"x"}`); rec.Code/100 != 2 {
+		t.Fatalf("write after maintenance = %d, want 2xx", rec.Code)
+	}
+}
+
+func TestAutoTitle(t *testing.T) {
+	_, h := newTestServer(t)
+	autoTitle = true
+	t.Cleanup(func() { autoTitle = false })
+
+	n := decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"content":"  Buy   milk\tand eggs\nthen call mom"}`))
+	if n.Title != "Buy milk and eggs" {
+		t.Fatalf("derived title = %q, want %q", n.Title, "Buy milk and eggs")
+	}
+	n = decodeNote(t, doRequest(h, "POST", "/v1/notes", `{"title":"Shopping","content":"Buy milk\nthen call mom"}`))
+	if n.Title != "Shopping" {
+		t.Fatalf("provided title was replaced with %q", n.Title)
+	}
+	long := strings.Repeat("word ", 30)
+	n = decodeNote(t, doRequest(h, "POST", "/v1/notes", fmt.Sprintf(`{"content":%q}`, long)))
+	if !strings.HasSuffix(n.Title, "...") || len([]rune(n.Title)) > autoTitleMaxLen+3 {
+		t.Fatalf("long title not cut: %q", n.Title)
+	}
+}
+
+func TestValidateNote(t *testing.T) {
+	s, h := newTestServer(t)
+	rec := doRequest(h, "POST", "/v1/notes/validate", `{"title":"ok","content":"fine"}`)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"valid":true}` {
+		t.Fatalf("valid note = %d %s, want 200 {\"valid\":true}", rec.Code, rec.Body.String())
+	}
+
+	rec = doRequest(h, "POST", "/v1/notes/validate", `{"title":"","content":"fine"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid note = %d, want 422", rec.Code)
+	}
+	var resp struct {
+		Valid  bool
+		Errors map[string]string
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Valid || resp.Errors["title"] == "" {
+		t.Fatalf("invalid note body = %s, want valid false and a title error", rec.Body.String())
+	}
+	if n := countNotes(t, s); n != 0 {
+		t.Fatalf("validate saved %d notes", n)
+	}
+}
+
+func TestListPreview(t *testing.T) {
+	_, h := newTestServer(t)
+	// 3-byte runes, so a byte cut would leave invalid utf-8
+	doRequest(h, "POST", "/v1/notes", `{"title":"long","content":"日本語のテキスト"}`)
+	doRequest(h, "POST", "/v1/notes", `{"title":"short","content":"日本"}`)
+
+	notes := decodeNotes(t, doRequest(h, "GET", "/v1/notes?preview=3", ""))
+	if len(notes) != 2 {
+		t.Fatalf("got %d notes, want 2", len(notes))
+	}
+	if notes[0].Content != "日本語…" || !notes[0].ContentTruncated {
+		t.Fatalf("long preview = %q truncated=%v, want %q truncated", notes[0].Content, notes[0].ContentTruncated, "日本語…")
+	}
+	if !utf8.ValidString(notes[0].Content) {
+		t.Fatalf("preview split a rune: %q", notes[0].Content)
+	}
+	if notes[1].Content != "日本" || notes[1].ContentTruncated {
+		t.Fatalf("short preview = %q truncated=%v, want it whole", notes[1].Content, notes[1].ContentTruncated)
+	}
+	if rec := doRequest(h, "GET", "/v1/notes?preview=0", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("preview=0 = %d, want 400", rec.Code)
+	}
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand/v2"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -16,29 +27,73 @@ type Note struct {
 	ID      int    `json:"id"`
 	Title   string `json:"title"`
 	Content string `json:"content"`
+	// nil -> never expires
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// 1 on create, +1 on every update. an update sending the version it read
+	// only applies if nobody changed the note since (0 or missing -> no check)
+	Version int `json:"version"`
+}
+
+// body of POST /notes, a note plus optional lifetime
+type createNoteRequest struct {
+	Note
+	ExpiresInSeconds int `json:"expires_in_seconds,omitempty"`
+}
+
+// expired notes act as deleted even before the sweeper removes them
+func expired(n Note, now time.Time) bool {
+	return n.ExpiresAt != nil && !now.Before(*n.ExpiresAt)
 }
 
 // for memory storage of notes like key, value pairs
 var notes = make(map[int]Note)
 
-// mutex ensure only one goroutine access the notes map at a time
-var mu sync.Mutex
+// guards the notes map: many readers at once (RLock), writers get it alone (Lock)
+var mu sync.RWMutex
+
+// last id handed out, only grows (under mu) so ids never repeat
+var nextID int
+
+// rough memory used by stored notes, changed together with the map under mu
+var notesBytes int
+
+// approx size of one note: text plus a guess for map entry/struct overhead
+func noteSize(n Note) int {
+	return len(n.Title) + len(n.Content) + 64
+}
 
 // create a new note (for POST request)
 // In GO every handler must have these 2 args
 // responseWriter -> to write response back to client
 // request -> represents all incoming request from client
 func createNewNoteHandler(w http.ResponseWriter, r *http.Request) {
-	var note Note
+	var req createNoteRequest
 	// decode json from request body into struct
-	err := json.NewDecoder(r.Body).Decode(&note)
+	err := decodeJSON(r, &req)
 	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
+	if req.ExpiresInSeconds < 0 {
+		http.Error(w, "expires_in_seconds must be positive", http.StatusBadRequest)
+		return
+	}
+	note := req.Note
+	// expiry only comes from expires_in_seconds, never from the client directly
+	note.ExpiresAt = nil
+	note.Version = 1
+	if req.ExpiresInSeconds > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		note.ExpiresAt = &t
+	}
 	mu.Lock()
-	note.ID = rand.IntN(100000)
+	nextID++
+	note.ID = nextID
 	notes[note.ID] = note //save note into map
+	notesBytes += noteSize(note)
 	mu.Unlock()
 
 	//headers describe that response is in json , not plain text
@@ -48,14 +103,17 @@ func createNewNoteHandler(w http.ResponseWriter, r *http.Request) {
 
 // get all notes (for GET request)
 func getNotesHandler(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
+	mu.RLock()
 	// convert map into slice of notes
 	// maps can't be directly converted to json arrays so we use slice
+	now := time.Now()
 	notesList := make([]Note, 0, len(notes))
 	for _, n := range notes {
-		notesList = append(notesList, n)
+		if !expired(n, now) {
+			notesList = append(notesList, n)
+		}
 	}
-	mu.Unlock()
+	mu.RUnlock()
 
 	//send all notes as json response
 	w.Header().Set("Content-Type", "application/json")
@@ -71,9 +129,10 @@ func getNoteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid note id", http.StatusBadRequest)
 		return
 	}
-	mu.Lock()
+	mu.RLock()
 	note, exists := notes[id]
-	mu.Unlock()
+	mu.RUnlock()
+	exists = exists && !expired(note, time.Now())
 
 	if !exists {
 		http.Error(w, "Note not found", http.StatusNotFound)
@@ -93,9 +152,12 @@ func deleteNoteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// lock and delete if exists
 	mu.Lock()
-	_, exists := notes[id]
+	old, exists := notes[id]
 	if exists {
 		delete(notes, id)
+		notesBytes -= noteSize(old)
+		// expired one is gone already as far as the client knows
+		exists = !expired(old, time.Now())
 	}
 	mu.Unlock()
 
@@ -108,17 +170,634 @@ func deleteNoteHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+var errNoteNotFound = errors.New("note not found")
+var errVersionConflict = errors.New("version conflict")
+
+// replace note id with title/content of next, but only while its version is still expected
+// (expected 0 -> replace whatever is there). check and write happen under one lock,
+// so of two updates that read the same version exactly one wins.
+// returns the stored note, on a conflict the current one
+func compareAndSwapNote(id, expected int, next Note) (Note, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	old, exists := notes[id]
+	// only replace if it exists, update never creates
+	if !exists || expired(old, time.Now()) {
+		return Note{}, errNoteNotFound
+	}
+	if expected != 0 && old.Version != expected {
+		return old, errVersionConflict
+	}
+	next.ID = id
+	next.ExpiresAt = old.ExpiresAt // update keeps the original lifetime
+	next.Version = old.Version + 1
+	notes[id] = next
+	notesBytes += noteSize(next) - noteSize(old)
+	return next, nil
+}
+
+// update note by id (keeps the id from the path)
+// send the "version" of the last read to not overwrite a change made since then (409)
+func updateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid note id", http.StatusBadRequest)
+		return
+	}
+	var note Note
+	err = decodeJSON(r, &note)
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	note, err = compareAndSwapNote(id, note.Version, note)
+	if errors.Is(err, errNoteNotFound) {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, errVersionConflict) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]any{"error": "note was changed in the meantime", "version": note.Version})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// how often expired notes are removed from the map
+var sweepInterval = 30 * time.Second
+
+// delete expired notes every sweepInterval, until ctx is done
+func sweepExpiredNotes(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sweepExpired(now)
+		}
+	}
+}
+
+// remove notes expired at now from the map, returns how many
+func sweepExpired(now time.Time) int {
+	mu.Lock()
+	defer mu.Unlock()
+	removed := 0
+	for id, n := range notes {
+		if expired(n, now) {
+			delete(notes, id)
+			notesBytes -= noteSize(n)
+			removed++
+		}
+	}
+	return removed
+}
+
+// liveness probe, there is no db so being able to answer is all it checks
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// memory usage of the store
+// notes counts only live ones, like the list. approx_bytes also has the expired
+// notes the sweeper hasn't removed yet, they still take up memory until then
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	mu.RLock()
+	live := 0
+	for _, n := range notes {
+		if !expired(n, now) {
+			live++
+		}
+	}
+	stats := map[string]int{
+		"notes":        live,
+		"approx_bytes": notesBytes,
+	}
+	mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// browser origins allowed to call this api, from ALLOWED_ORIGINS (comma separated)
+// empty -> no CORS headers, only same-origin pages can use it
+var allowedOrigins = map[string]bool{}
+
+func parseAllowedOrigins(v string) {
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			allowedOrigins[o] = true
+		}
+	}
+}
+
+// what cross-origin requests may send
+const corsAllowMethods = "GET, POST, PUT, DELETE"
+const corsAllowHeaders = "Content-Type, X-Request-ID"
+const corsExposeHeaders = "X-Request-ID"
+
+// echoes the origin back only when allowlisted (never "*", so cookies/auth headers work)
+// preflight OPTIONS is answered here with 204, router has no OPTIONS routes
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !allowedOrigins[origin] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		h.Add("Vary", "Origin")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ========== REQUEST ID ============//
+// every request gets an id: the caller's X-Request-ID if it looks sane, else a new uuid
+// it is echoed back in the response and logged, so one request can be followed across services
+
+type ctxKey string
+
+const requestIDKey ctxKey = "requestId"
+
+// longer or odd looking ids are replaced, they end up in log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// random (version 4) uuid
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// "" when the request didn't go through requestIDMiddleware
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// one line per request, text by default, LOG_FORMAT=json for log collectors
+var accessLog = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+func setLogFormat(format string) {
+	switch strings.ToLower(format) {
+	case "", "text":
+	case "json":
+		accessLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	default:
+		log.Printf("unknown LOG_FORMAT=%q, using text", format)
+	}
+}
+
+// remembers status and bytes written so they can be logged afterwards
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.size += n
+	return n, err
+}
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		// handler that writes nothing is an implicit 200
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		accessLog.Info("request",
+			"request_id", requestIDFromContext(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sr.status,
+			"size", sr.size,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+// ========== GZIP ============//
+// for list endpoints, wrap the handler: gzipMiddleware(http.HandlerFunc(h))
+
+// smaller bodies are sent as is, gzip overhead isn't worth it
+const gzipMinSize = 1024
+
+// true when Accept-Encoding lists gzip with a non-zero q
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(v, 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// holds back the first gzipMinSize bytes to decide if compressing is worth it
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	buf     []byte
+	status  int
+	started bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
+	}
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.started {
+		g.buf = append(g.buf, b...)
+		if len(g.buf) < gzipMinSize {
+			return len(b), nil
+		}
+		if err := g.start(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// sends the header and whatever is buffered, compressed or not
+func (g *gzipWriter) start() error {
+	g.started = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	h := g.Header()
+	ct := h.Get("Content-Type")
+	// already encoded by the handler, or a format that is compressed anyway
+	compressed := h.Get("Content-Encoding") != "" || strings.HasPrefix(ct, "image/") ||
+		ct == "application/zip" || ct == "application/gzip"
+	if len(g.buf) >= gzipMinSize && !compressed && g.status != http.StatusNoContent && g.status != http.StatusNotModified {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(g.buf)
+	} else {
+		_, err = g.ResponseWriter.Write(g.buf)
+	}
+	g.buf = nil
+	return err
+}
+
+func (g *gzipWriter) Flush() {
+	if !g.started {
+		g.start()
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writes out a small body that never reached gzipMinSize, and the gzip footer
+func (g *gzipWriter) close() {
+	if !g.started {
+		g.start()
+	}
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// caches must keep gzip and plain versions apart
+		w.Header().Add("Vary", "Accept-Encoding")
+		g := &gzipWriter{ResponseWriter: w}
+		defer g.close()
+		next.ServeHTTP(g, r)
+	})
+}
+
+// max size of a POST/PUT/PATCH body, MAX_BODY_BYTES to change
+var maxBodyBytes int64 = 1 << 20
+
+// cap request bodies so a huge payload can't eat all memory while decoding
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decode json body, unknown fields are an error so client typos don't get silently dropped
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// sends 413 and returns true when err came from hitting maxBodyBytes
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return true
+	}
+	return false
+}
+
+// turns a handler panic into a 500 instead of killing the connection
+// stack goes to the log, client only gets a generic message
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// net/http uses this one on purpose to abort a response, let it through
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			log.Printf("panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestIDFromContext(r.Context()), p, debug.Stack())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ========== PERSISTENCE ============//
+// NOTES_FILE=path -> map is saved there on graceful shutdown and loaded back on start
+// empty (default) -> nothing is persisted, like before
+var notesFile string
+
+// what goes into the file, next id included so ids keep growing after restart
+type snapshot struct {
+	NextID int    `json:"next_id"`
+	Notes  []Note `json:"notes"`
+}
+
+// load notes from notesFile, missing or broken file -> start empty
+func loadNotes() {
+	if notesFile == "" {
+		return
+	}
+	data, err := os.ReadFile(notesFile)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("warning: %s does not exist, starting with no notes", notesFile)
+		return
+	} else if err != nil {
+		log.Printf("warning: reading %s: %v, starting with no notes", notesFile, err)
+		return
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		log.Printf("warning: %s is corrupt (%v), starting with no notes", notesFile, err)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	nextID = snap.NextID
+	for _, n := range snap.Notes {
+		notes[n.ID] = n
+		notesBytes += noteSize(n)
+		nextID = max(nextID, n.ID)
+	}
+	log.Printf("loaded %d notes from %s", len(snap.Notes), notesFile)
+}
+
+// write all notes to notesFile
+// goes to a temp file first and is renamed over the old one, so a crash mid-write can't leave half a file
+func saveNotes() error {
+	if notesFile == "" {
+		return nil
+	}
+	mu.RLock()
+	snap := snapshot{NextID: nextID, Notes: make([]Note, 0, len(notes))}
+	for _, n := range notes {
+		snap.Notes = append(snap.Notes, n)
+	}
+	mu.RUnlock()
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp := notesFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, notesFile)
+}
+
+// requests being served right now, reported when shutting down
+var inFlight atomic.Int64
+
+func inFlightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// set by serve once SIGINT/SIGTERM arrived
+var shuttingDown atomic.Bool
+
+// 503 for anything that still comes in while draining (keep-alive conns, the load balancer
+// not caught up yet), so clients retry on another instance. probes still answer, /readyz says 503 itself
+func shutdownMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isProbe := r.URL.Path == "/livez" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+		if shuttingDown.Load() && !isProbe {
+			w.Header().Set("Retry-After", strconv.Itoa(int(shutdownTimeout/time.Second)))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": "server is shutting down"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middleware around the whole router instead of r.Use: mux runs r.Use middleware only
+// for a matched route, so its own 404/405 would get no request id and no access log line
+// same in every service
+func serverHandler(h http.Handler) http.Handler {
+	return requestIDMiddleware(loggingMiddleware(recoverMiddleware(inFlightMiddleware(shutdownMiddleware(corsMiddleware(h))))))
+}
+
+// how long running requests get to finish after SIGINT/SIGTERM
+var shutdownTimeout = 15 * time.Second
+
+// background loops (expired note sweeper), serve cancels backgroundCtx on shutdown
+// and waits (up to shutdownTimeout) for all of them to return before saving the notes
+var backgroundCtx, stopBackground = context.WithCancel(context.Background())
+var background sync.WaitGroup
+
+// run fn in its own goroutine until backgroundCtx is done
+func runBackground(fn func(ctx context.Context)) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn(backgroundCtx)
+	}()
+}
+
+// cancel the background workers and wait for them, false if they were still running after timeout
+func stopBackgroundWorkers(timeout time.Duration) bool {
+	stopBackground()
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// serve until SIGINT/SIGTERM, then stop accepting connections and wait for running requests
+func serve(srv *http.Server) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	sig := <-stop
+	shuttingDown.Store(true)
+	pending := inFlight.Load()
+	log.Printf("got %v, draining %d in-flight requests", sig, pending)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown timed out with %d requests still running: %v", inFlight.Load(), err)
+	} else {
+		log.Printf("drained %d requests, server stopped", pending)
+	}
+	if !stopBackgroundWorkers(shutdownTimeout) {
+		log.Printf("background workers still running after %v", shutdownTimeout)
+	}
+	// after Shutdown, so no request can change the map while it is saved
+	if err := saveNotes(); err != nil {
+		log.Printf("saving notes to %s: %v", notesFile, err)
+	}
+}
+
 // MAIN Function
 func main() {
 	// create new router
 	// router is responsible for matching incoming req to correct handler
 	r := mux.NewRouter()
-	r.HandleFunc("/notes", createNewNoteHandler).Methods("POST")     // create new note
-	r.HandleFunc("/notes", getNotesHandler).Methods("GET")           // get all notes
-	r.HandleFunc("/notes/{id}", getNoteHandler).Methods("GET")       // get note by ID
-	r.HandleFunc("/notes/{id}", deleteNoteHandler).Methods("DELETE") // delete note by ID
+	setLogFormat(os.Getenv("LOG_FORMAT"))
+	parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	if v := os.Getenv("MAX_BODY_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatal("MAX_BODY_BYTES must be a positive number")
+		}
+		maxBodyBytes = n
+	}
+	notesFile = os.Getenv("NOTES_FILE")
+	loadNotes()
+	runBackground(sweepExpiredNotes)
+	r.Use(bodyLimitMiddleware)
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET") // liveness probe
+	// all but the probe under /v1, so a /v2 can be added next to it later
+	v1 := r.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/notes", createNewNoteHandler).Methods("POST")                         // create new note
+	v1.Handle("/notes", gzipMiddleware(http.HandlerFunc(getNotesHandler))).Methods("GET") // get all notes
+	v1.HandleFunc("/notes/{id}", getNoteHandler).Methods("GET")                           // get note by ID
+	v1.HandleFunc("/notes/{id}", deleteNoteHandler).Methods("DELETE")                     // delete note by ID
+	v1.HandleFunc("/notes/{id}", updateNoteHandler).Methods("PUT")                        // update note by ID
+	v1.HandleFunc("/stats", statsHandler).Methods("GET")                                  // store size
 
 	//start server
-	fmt.Println("Server running on local host: 8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	fmt.Println("Server running on local host: 8080, api at /v1")
+	srv := &http.Server{Addr: ":8080", Handler: serverHandler(r)}
+	serve(srv)
 }
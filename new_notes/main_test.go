@@ -0,0 +1,438 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// empty store, put back as it was after the test
+func resetStore(t *testing.T) {
+	t.Helper()
+	mu.Lock()
+	saved, savedID, savedBytes := notes, nextID, notesBytes
+	notes, nextID, notesBytes = make(map[int]Note), 0, 0
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		notes, nextID, notesBytes = saved, savedID, savedBytes
+		mu.Unlock()
+	})
+}
+
+func createNote(title string) (Note, int) {
+	req := httptest.NewRequest("POST", "/v1/notes", strings.NewReader(fmt.Sprintf(`{"title":%q,"content":"c"}`, title)))
+	rec := httptest.NewRecorder()
+	createNewNoteHandler(rec, req)
+	var n Note
+	json.NewDecoder(rec.Body).Decode(&n)
+	return n, rec.Code
+}
+
+func TestConcurrentCreateDistinctIDs(t *testing.T) {
+	resetStore(t)
+	const count = 200
+	ids := make(chan int, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, code := createNote(fmt.Sprintf("note %d", i))
+			if code != http.StatusOK {
+				t.Errorf("create %d = %d", i, code)
+			}
+			ids <- n.ID
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[int]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("id %d handed out twice", id)
+		}
+		seen[id] = true
+	}
+	mu.RLock()
+	stored := len(notes)
+	mu.RUnlock()
+	if len(seen) != count || stored != count {
+		t.Fatalf("%d distinct ids, %d stored notes, want %d", len(seen), stored, count)
+	}
+}
+
+// store with n notes for the read benchmarks
+func seedNotes(b *testing.B, n int) {
+	b.Helper()
+	mu.Lock()
+	saved, savedID, savedBytes := notes, nextID, notesBytes
+	notes, nextID, notesBytes = make(map[int]Note, n), 0, 0
+	for i := 1; i <= n; i++ {
+		nextID = i
+		notes[i] = Note{ID: i, Title: fmt.Sprintf("note %d", i), Content: strings.Repeat("x", 200)}
+	}
+	mu.Unlock()
+	b.Cleanup(func() {
+		mu.Lock()
+		notes, nextID, notesBytes = saved, savedID, savedBytes
+		mu.Unlock()
+	})
+}
+
+// readers share the RLock, compare with -cpu 1,4,8
+func BenchmarkGetNoteParallel(b *testing.B) {
+	seedNotes(b, 1000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			id := strconv.Itoa(i%1000 + 1)
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/v1/notes/"+id, nil), map[string]string{"id": id})
+			rec := httptest.NewRecorder()
+			getNoteHandler(rec, req)
+			if rec.Code != http.StatusOK {
+				b.Fatal(rec.Code)
+			}
+		}
+	})
+}
+
+func BenchmarkGetNotesParallel(b *testing.B) {
+	seedNotes(b, 100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rec := httptest.NewRecorder()
+			getNotesHandler(rec, httptest.NewRequest("GET", "/v1/notes", nil))
+			if rec.Code != http.StatusOK {
+				b.Fatal(rec.Code)
+			}
+		}
+	})
+}
+
+func TestListGzip(t *testing.T) {
+	resetStore(t)
+	for i := 0; i < 40; i++ {
+		createNote(fmt.Sprintf("note %d with some title text", i))
+	}
+	h := gzipMiddleware(http.HandlerFunc(getNotesHandler))
+	req := httptest.NewRequest("GET", "/v1/notes", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", rec.Header().Get("Content-Encoding"))
+	}
+	if !slices.Contains(rec.Header().Values("Vary"), "Accept-Encoding") {
+		t.Fatalf("Vary = %v, want Accept-Encoding", rec.Header().Values("Vary"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Note
+	if err := json.NewDecoder(zr).Decode(&got); err != nil || len(got) != 40 {
+		t.Fatalf("decoded %d notes, %v", len(got), err)
+	}
+}
+
+// while draining, requests get 503 + Retry-After, probes still answer
+func TestShutdownRejectsNewRequests(t *testing.T) {
+	resetStore(t)
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", healthzHandler)
+	r.HandleFunc("/v1/notes", getNotesHandler)
+	h := serverHandler(r)
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/notes", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("during shutdown: %d, Retry-After %q, want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("probe during shutdown = %d, want 200", rec.Code)
+	}
+	shuttingDown.Store(false)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/notes", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("before shutdown = %d, want 200", rec.Code)
+	}
+}
+
+// serve's shutdown cancels the sweeper and waits until it returned
+func TestBackgroundWorkersStopOnShutdown(t *testing.T) {
+	defer func(ctx context.Context, cancel context.CancelFunc) {
+		backgroundCtx, stopBackground = ctx, cancel
+	}(backgroundCtx, stopBackground)
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+
+	returned := make(chan struct{})
+	runBackground(func(ctx context.Context) {
+		sweepExpiredNotes(ctx)
+		close(returned)
+	})
+	if !stopBackgroundWorkers(5 * time.Second) {
+		t.Fatal("sweeper did not stop")
+	}
+	select {
+	case <-returned:
+	default:
+		t.Fatal("wait finished before the sweeper returned")
+	}
+	if backgroundCtx.Err() != context.Canceled {
+		t.Fatalf("ctx err = %v, want context.Canceled", backgroundCtx.Err())
+	}
+}
+
+func updateNote(id int, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", fmt.Sprintf("/v1/notes/%d", id), strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(id)})
+	rec := httptest.NewRecorder()
+	updateNoteHandler(rec, req)
+	return rec
+}
+
+// run with -race: all updates for the same version race, exactly one may win
+func TestConcurrentUpdateCompareAndSwap(t *testing.T) {
+	resetStore(t)
+	n, _ := createNote("start")
+	if n.Version != 1 {
+		t.Fatalf("new note version = %d, want 1", n.Version)
+	}
+	const workers = 20
+	codes := make([]int, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = updateNote(n.ID, fmt.Sprintf(`{"title":"w%d","content":"c","version":1}`, i)).Code
+		}(i)
+	}
+	wg.Wait()
+	won := 0
+	for _, c := range codes {
+		switch c {
+		case http.StatusOK:
+			won++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("unexpected status %d", c)
+		}
+	}
+	if won != 1 {
+		t.Fatalf("%d updates applied for version 1, want exactly 1", won)
+	}
+
+	// read-modify-write with retry on 409: no increment gets lost
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				mu.RLock()
+				cur := notes[n.ID]
+				mu.RUnlock()
+				rec := updateNote(n.ID, fmt.Sprintf(`{"title":"w%d","content":"c","version":%d}`, i, cur.Version))
+				if rec.Code == http.StatusOK {
+					return
+				}
+				if rec.Code != http.StatusConflict {
+					t.Errorf("unexpected status %d", rec.Code)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	mu.RLock()
+	final := notes[n.ID]
+	mu.RUnlock()
+	if final.Version != 2+workers {
+		t.Fatalf("final version = %d, want %d", final.Version, 2+workers)
+	}
+	// no version -> plain overwrite, as before
+	if rec := updateNote(n.ID, `{"title":"x","content":"c"}`); rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	// stale version -> 409 with the current one
+	rec := updateNote(n.ID, `{"title":"y","content":"c","version":1}`)
+	var body struct{ Version int }
+	json.NewDecoder(rec.Body).Decode(&body)
+	if rec.Code != http.StatusConflict || body.Version != 3+workers {
+		t.Fatalf("stale update = %d, version %d", rec.Code, body.Version)
+	}
+}
+
+// a panicking handler gets a json 500, the server keeps serving the next requests
+func TestPanicRecovered(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	r.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	srv := httptest.NewServer(serverHandler(r))
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/panic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]string
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Content-Type") != "application/json" || body["error"] == "" {
+			t.Fatalf("panic = %d %q %v, want json 500", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+		resp, err = http.Get(srv.URL + "/ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("after a panic = %d, want 200", resp.StatusCode)
+		}
+	}
+}
+
+func TestUpdateKeepsIDAndExpiry(t *testing.T) {
+	resetStore(t)
+	rec := httptest.NewRecorder()
+	createNewNoteHandler(rec, httptest.NewRequest("POST", "/v1/notes", strings.NewReader(`{"title":"a","content":"c","expires_in_seconds":3600}`)))
+	var created Note
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.ExpiresAt == nil {
+		t.Fatal("created note has no expiry")
+	}
+
+	// id and expires_at in the body are ignored
+	rec = updateNote(created.ID, `{"id":999,"title":"b","content":"d","expires_at":"2000-01-01T00:00:00Z"}`)
+	var updated Note
+	json.NewDecoder(rec.Body).Decode(&updated)
+	if rec.Code != http.StatusOK || updated.ID != created.ID || updated.Title != "b" {
+		t.Fatalf("update = %d %+v", rec.Code, updated)
+	}
+	if updated.ExpiresAt == nil || !updated.ExpiresAt.Equal(*created.ExpiresAt) {
+		t.Fatalf("expiry changed from %v to %v", created.ExpiresAt, updated.ExpiresAt)
+	}
+	mu.RLock()
+	stored, ok := notes[created.ID]
+	_, other := notes[999]
+	mu.RUnlock()
+	if !ok || other || stored.Title != "b" || !stored.ExpiresAt.Equal(*created.ExpiresAt) {
+		t.Fatalf("stored %+v (note 999 exists: %v)", stored, other)
+	}
+
+	if rec := updateNote(12345, `{"title":"x","content":"y"}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("update of a missing note = %d, want 404", rec.Code)
+	}
+	mu.RLock()
+	_, created404 := notes[12345]
+	mu.RUnlock()
+	if created404 {
+		t.Fatal("update created the missing note")
+	}
+}
+
+func getStats(t *testing.T) map[string]int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	statsHandler(rec, httptest.NewRequest("GET", "/v1/stats", nil))
+	var stats map[string]int
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestExpiredNotesHiddenAndSwept(t *testing.T) {
+	resetStore(t)
+	live, _ := createNote("live")
+	gone, _ := createNote("gone")
+	past := time.Now().Add(-time.Minute)
+	mu.Lock()
+	n := notes[gone.ID]
+	n.ExpiresAt = &past
+	notes[gone.ID] = n
+	mu.Unlock()
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", fmt.Sprintf("/v1/notes/%d", gone.ID), nil), map[string]string{"id": strconv.Itoa(gone.ID)})
+	rec := httptest.NewRecorder()
+	getNoteHandler(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("GET expired note = %d, want 404", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	getNotesHandler(rec, httptest.NewRequest("GET", "/v1/notes", nil))
+	var list []Note
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list) != 1 || list[0].ID != live.ID {
+		t.Fatalf("list = %+v, want only the live note", list)
+	}
+	before := getStats(t)
+	if before["notes"] != 1 {
+		t.Fatalf("stats notes = %d before the sweep, want 1", before["notes"])
+	}
+
+	if removed := sweepExpired(time.Now()); removed != 1 {
+		t.Fatalf("sweep removed %d, want 1", removed)
+	}
+	mu.RLock()
+	_, stillThere := notes[gone.ID]
+	mu.RUnlock()
+	if stillThere {
+		t.Fatal("expired note still in the map after the sweep")
+	}
+	after := getStats(t)
+	if after["notes"] != 1 || after["approx_bytes"] != before["approx_bytes"]-noteSize(n) {
+		t.Fatalf("stats after sweep = %v, before %v", after, before)
+	}
+}
+
+func TestStatsAfterCreatesAndDeletes(t *testing.T) {
+	resetStore(t)
+	var ids []int
+	for i := 0; i < 3; i++ {
+		n, code := createNote(fmt.Sprintf("note %d", i))
+		if code/100 != 2 {
+			t.Fatalf("create = %d", code)
+		}
+		ids = append(ids, n.ID)
+	}
+	stats := getStats(t)
+	if stats["notes"] != 3 || stats["approx_bytes"] <= 0 {
+		t.Fatalf("stats after 3 creates = %v", stats)
+	}
+	full := stats["approx_bytes"]
+
+	for _, id := range ids[:2] {
+		id := strconv.Itoa(id)
+		rec := httptest.NewRecorder()
+		deleteNoteHandler(rec, mux.SetURLVars(httptest.NewRequest("DELETE", "/v1/notes/"+id, nil), map[string]string{"id": id}))
+		if rec.Code/100 != 2 {
+			t.Fatalf("delete = %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	stats = getStats(t)
+	if stats["notes"] != 1 || stats["approx_bytes"] <= 0 || stats["approx_bytes"] >= full {
+		t.Fatalf("stats after 2 deletes = %v (was %d bytes)", stats, full)
+	}
+}